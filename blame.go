@@ -0,0 +1,72 @@
+package weeded
+
+import (
+	"bytes"
+)
+
+// BlameLine attributes a line to the op which last inserted text into it.
+// Lines which are older than the oldest op known have Ix -1.
+type BlameLine struct {
+	UID uint64
+	Ix  int64
+}
+
+// BlameMsg holds the attribution of every line of a buffer at revision Ix.
+type BlameMsg struct {
+	Ix    int64
+	Lines []BlameLine
+}
+
+// Blame replays msgs on base and returns the attribution of every line of
+// the resulting document. A line includes its trailing newline.
+func Blame(base []byte, msgs []OtMsg) ([]BlameLine, error) {
+	doc := make([]byte, len(base))
+	copy(doc, base)
+	authors := make([]BlameLine, len(base))
+	for i := range authors {
+		authors[i].Ix = -1
+	}
+
+	var err error
+	for _, otmsg := range msgs {
+		doc, err = otmsg.Op.ApplyTo(doc)
+		if err != nil {
+			return nil, err
+		}
+		next := make([]BlameLine, 0, len(doc))
+		docIx := 0
+		for _, sop := range otmsg.Op {
+			switch {
+			case sop.IsRetain():
+				next = append(next, authors[docIx:docIx+sop.N]...)
+				docIx += sop.N
+			case sop.IsInsert():
+				for i := 0; i < sop.N; i++ {
+					next = append(next, BlameLine{UID: otmsg.UID, Ix: otmsg.Ix})
+				}
+			case sop.IsDelete():
+				docIx -= sop.N
+			}
+		}
+		authors = next
+	}
+
+	var lines []BlameLine
+	for start := 0; start < len(doc); {
+		end := bytes.IndexByte(doc[start:], '\n') + 1
+		if end == 0 {
+			end = len(doc)
+		} else {
+			end += start
+		}
+		line := authors[start]
+		for _, a := range authors[start+1 : end] {
+			if a.Ix > line.Ix {
+				line = a
+			}
+		}
+		lines = append(lines, line)
+		start = end
+	}
+	return lines, nil
+}
@@ -0,0 +1,29 @@
+package weeded
+
+import (
+	"testing"
+
+	"github.com/dane-unltd/weeded/ot"
+)
+
+func TestBlame(t *testing.T) {
+	base := []byte("one\ntwo\n")
+	msgs := []OtMsg{
+		{Ix: 0, UID: 1, Op: ot.Op{}.Retain(8).Insert("three\nfour")},
+		{Ix: 1, UID: 2, Op: ot.Op{}.Retain(4).Delete("two").Insert("2").Retain(11)},
+		{Ix: 2, UID: 3, Op: ot.Op{}.Retain(8).Insert("\n").Retain(8)},
+	}
+	lines, err := Blame(base, msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []BlameLine{{0, -1}, {2, 1}, {3, 2}, {1, 0}, {1, 0}}
+	if len(lines) != len(want) {
+		t.Fatal("unexpected number of lines", lines)
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("line %d: got %v, want %v", i, lines[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,233 @@
+// Package client implements the client side of the OT protocol spoken by
+// weededd. A Client keeps track of the last revision acknowledged by the
+// server, at most one op in flight and a buffer of local ops composed into a
+// single op waiting to be sent. Ops are numbered, so the server recognizes
+// the ones sent again after the connection was lost.
+package client
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/dane-unltd/weeded/ot"
+)
+
+type State int
+
+const (
+	Synchronized State = iota
+	AwaitingAck
+	AwaitingWithBuffer
+	Resuming
+)
+
+func (s State) String() string {
+	switch s {
+	case Synchronized:
+		return "synchronized"
+	case AwaitingAck:
+		return "awaiting"
+	case AwaitingWithBuffer:
+		return "buffer"
+	case Resuming:
+		return "resuming"
+	}
+	return "unknown"
+}
+
+type Client struct {
+	rev      int64
+	state    State
+	inflight ot.Op
+	buffer   ot.Op
+	// seq is the sequence number of the op in flight, the last one
+	// assigned.
+	seq uint64
+	// resumed and resumeSeqs hold the ops sent with a resume, while
+	// Resuming.
+	resumed    []ot.Op
+	resumeSeqs []uint64
+}
+
+// New returns a client for a document at revision rev, as received in a
+// "buffer" message.
+func New(rev int64) *Client {
+	return &Client{rev: rev, seq: seqStart()}
+}
+
+// seqStart returns a random sequence number to count up from, so the ops
+// of clients sharing a uid are not taken for each other. It stays below
+// 2^52 to fit the integers of JavaScript clients.
+func seqStart() uint64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		binary.LittleEndian.PutUint64(b[:], uint64(time.Now().UnixNano()))
+	}
+	return binary.LittleEndian.Uint64(b[:]) & (1<<52 - 1)
+}
+
+// Rev returns the revision of the last op received from the server.
+func (c *Client) Rev() int64 {
+	return c.rev
+}
+
+func (c *Client) State() State {
+	return c.state
+}
+
+// Local registers an op which has already been applied to the local
+// document. If send is true, op has to be sent to the server based on
+// revision ix.
+func (c *Client) Local(op ot.Op) (send bool, ix int64, err error) {
+	switch c.state {
+	case Synchronized:
+		c.inflight = op
+		c.state = AwaitingAck
+		c.seq++
+		return true, c.rev, nil
+	case AwaitingAck:
+		c.buffer = op
+		c.state = AwaitingWithBuffer
+	case AwaitingWithBuffer, Resuming:
+		if c.buffer == nil {
+			c.buffer = op
+			break
+		}
+		c.buffer, err = ot.Compose(c.buffer, op)
+		if err != nil {
+			return
+		}
+	}
+	return false, 0, nil
+}
+
+// Seq returns the sequence number of the op in flight, to be sent along
+// with it in OtMsg.Seq.
+func (c *Client) Seq() uint64 {
+	return c.seq
+}
+
+// Remote transforms an op received from the server against the pending local
+// ops. The returned op can be applied to the local document.
+func (c *Client) Remote(op ot.Op) (ot.Op, error) {
+	var err error
+	switch c.state {
+	case Resuming:
+		return nil, errors.New("op received while resuming")
+	case AwaitingAck:
+		op, c.inflight, err = ot.Transform(op, c.inflight)
+		if err != nil {
+			return nil, err
+		}
+	case AwaitingWithBuffer:
+		op, c.inflight, err = ot.Transform(op, c.inflight)
+		if err != nil {
+			return nil, err
+		}
+		op, c.buffer, err = ot.Transform(op, c.buffer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.rev++
+	return op, nil
+}
+
+// Ack handles the acknowledgement of the op in flight. If send is true, the
+// buffered ops have been composed into op which has to be sent to the server
+// based on revision ix.
+func (c *Client) Ack() (send bool, ix int64, op ot.Op, err error) {
+	switch c.state {
+	case Synchronized, Resuming:
+		return false, 0, nil, errors.New("no op awaiting acknowledgement")
+	case AwaitingAck:
+		c.inflight = nil
+		c.state = Synchronized
+		c.rev++
+		return false, 0, nil, nil
+	}
+	c.inflight = c.buffer
+	c.buffer = nil
+	c.state = AwaitingAck
+	c.seq++
+	c.rev++
+	return true, c.rev, c.inflight, nil
+}
+
+// Resume returns the ops to send in a "resume" once the connection to the
+// server has been lost: the op in flight and the buffered op, each based on
+// the one before, their sequence numbers and the revision ix they are based
+// on. The client is Resuming until the reply is passed to Resumed, local ops
+// are buffered meanwhile. If the connection is lost again before, Resume
+// returns the same ops followed by the ones buffered since.
+func (c *Client) Resume() (ix int64, ops []ot.Op, seqs []uint64) {
+	if c.state != Resuming {
+		c.resumed, c.resumeSeqs = nil, nil
+		if c.state != Synchronized {
+			c.resumed = append(c.resumed, c.inflight)
+			c.resumeSeqs = append(c.resumeSeqs, c.seq)
+		}
+		c.inflight = nil
+		c.state = Resuming
+	}
+	if c.buffer != nil {
+		c.seq++
+		c.resumed = append(c.resumed, c.buffer)
+		c.resumeSeqs = append(c.resumeSeqs, c.seq)
+		c.buffer = nil
+	}
+	ops = append([]ot.Op(nil), c.resumed...)
+	seqs = append([]uint64(nil), c.resumeSeqs...)
+	return c.rev, ops, seqs
+}
+
+// Resumed handles the reply to a resume, which brought the server to
+// revision ix. The ops the client missed, remote, are transformed past the
+// local ops made while resuming and returned, to be applied to the local
+// document in order. If send is true, those local ops have been composed
+// into op, which has to be sent to the server based on revision ix.
+func (c *Client) Resumed(ix int64, remote []ot.Op) (ops []ot.Op, send bool, op ot.Op, err error) {
+	if c.state != Resuming {
+		return nil, false, nil, errors.New("no resume awaiting a reply")
+	}
+	ops = make([]ot.Op, len(remote))
+	for i, r := range remote {
+		if c.buffer != nil {
+			r, c.buffer, err = ot.Transform(r, c.buffer)
+			if err != nil {
+				return nil, false, nil, err
+			}
+		}
+		ops[i] = r
+	}
+	c.rev = ix
+	c.resumed, c.resumeSeqs = nil, nil
+	c.state = Synchronized
+	if c.buffer == nil {
+		return ops, false, nil, nil
+	}
+	c.inflight = c.buffer
+	c.buffer = nil
+	c.state = AwaitingAck
+	c.seq++
+	return ops, true, c.inflight, nil
+}
+
+// Selection transforms a selection received from the server, which is
+// based on the current revision, to the local document.
+func (c *Client) Selection(sel ot.Selection) ot.Selection {
+	if c.state == AwaitingAck || c.state == AwaitingWithBuffer {
+		sel = sel.Transform(c.inflight)
+	}
+	if c.state != AwaitingAck && c.buffer != nil {
+		sel = sel.Transform(c.buffer)
+	}
+	return sel
+}
+
+// Outstanding returns the op in flight and the buffered op.
+func (c *Client) Outstanding() (inflight, buffer ot.Op) {
+	return c.inflight, c.buffer
+}
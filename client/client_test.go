@@ -0,0 +1,223 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dane-unltd/weeded"
+	"github.com/dane-unltd/weeded/ot"
+)
+
+type server struct {
+	doc  []byte
+	hist []ot.Op
+}
+
+func (s *server) apply(t *testing.T, ix int64, op ot.Op) ot.Op {
+	var err error
+	for _, old := range s.hist[ix:] {
+		_, op, err = ot.Transform(old, op)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.doc, err = op.ApplyTo(s.doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.hist = append(s.hist, op)
+	return op
+}
+
+type peer struct {
+	c    *Client
+	doc  []byte
+	sent ot.Op
+	ix   int64
+}
+
+func (p *peer) local(t *testing.T, op ot.Op) {
+	var err error
+	p.doc, err = op.ApplyTo(p.doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send, ix, err := p.c.Local(op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if send {
+		p.sent, p.ix = op, ix
+	}
+}
+
+func (p *peer) remote(t *testing.T, op ot.Op) {
+	op, err := p.c.Remote(op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.doc, err = op.ApplyTo(p.doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClient(t *testing.T) {
+	s := &server{doc: []byte("Hello World!")}
+	a := &peer{c: New(0), doc: []byte("Hello World!")}
+	b := &peer{c: New(0), doc: []byte("Hello World!")}
+
+	a.local(t, ot.Op{}.Retain(6).Insert("wide ").Retain(6))
+	a.local(t, ot.Op{}.Retain(17).Insert(" and stuff"))
+	b.local(t, ot.Op{}.Delete("Hello").Retain(7))
+
+	if a.c.State() != AwaitingWithBuffer || b.c.State() != AwaitingAck {
+		t.Fatal("unexpected states", a.c.State(), b.c.State())
+	}
+
+	// b's op reaches the server first.
+	opb := s.apply(t, b.ix, b.sent)
+	a.remote(t, opb)
+	if send, _, _, err := b.c.Ack(); send || err != nil {
+		t.Fatal("unexpected ack result", send, err)
+	}
+
+	opa := s.apply(t, a.ix, a.sent)
+	b.remote(t, opa)
+	send, ix, op, err := a.c.Ack()
+	if !send || err != nil {
+		t.Fatal("buffered op not sent", err)
+	}
+	opa = s.apply(t, ix, op)
+	b.remote(t, opa)
+	if _, _, _, err := a.c.Ack(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := " wide World! and stuff"
+	for _, doc := range [][]byte{s.doc, a.doc, b.doc} {
+		if string(doc) != want {
+			t.Errorf("got %q, want %q", doc, want)
+		}
+	}
+	if a.c.Rev() != 3 || b.c.Rev() != 3 {
+		t.Error("unexpected revisions", a.c.Rev(), b.c.Rev())
+	}
+}
+
+func TestClientResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weeded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "test.txt")
+	err = ioutil.WriteFile(name, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := weeded.OpenFile(name, weeded.NewMemStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	p := &peer{c: New(f.Current().Ix)}
+	p.local(t, ot.Op{}.Insert("hello"))
+	p.local(t, ot.Op{}.Retain(5).Insert("!"))
+
+	// the op in flight is applied, but the connection is lost before
+	// it is acknowledged
+	_, _, err = f.ApplySeq(1, p.c.Seq(), p.ix, p.sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix, ops, seqs := p.c.Resume()
+	if len(ops) != 2 || len(seqs) != 2 || seqs[0] == seqs[1] {
+		t.Fatal("unexpected ops to resume", ops, seqs)
+	}
+
+	// and again before the reply to the resume arrives
+	p.local(t, ot.Op{}.Retain(6).Insert("?"))
+	_, _, err = f.Resume(1, ix, ops, seqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix, ops, seqs = p.c.Resume()
+	if len(ops) != 3 || len(seqs) != 3 {
+		t.Fatal("unexpected ops to resume", ops, seqs)
+	}
+	remote, _, err := f.Resume(1, ix, ops, seqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.local(t, ot.Op{}.Insert(">").Retain(7))
+	remote, send, op, err := p.c.Resumed(f.Current().Ix, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range remote {
+		p.doc, err = op.ApplyTo(p.doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !send {
+		t.Fatal("op made while resuming not sent")
+	}
+	_, _, err = f.ApplySeq(1, p.c.Seq(), p.c.Rev(), op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := p.c.Ack(); err != nil {
+		t.Fatal(err)
+	}
+
+	cur := f.Current()
+	if string(p.doc) != cur.Content || cur.Content != ">hello!?" || p.c.Rev() != cur.Ix {
+		t.Errorf("client has %q at %d, file %q at %d", p.doc, p.c.Rev(), cur.Content, cur.Ix)
+	}
+}
+
+func TestClientsSharingUID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weeded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "test.txt")
+	err = ioutil.WriteFile(name, []byte("hello"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := weeded.OpenFile(name, weeded.NewMemStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// two tabs of the same user
+	rev := f.Current().Ix
+	a := &peer{c: New(rev), doc: []byte("hello")}
+	b := &peer{c: New(rev), doc: []byte("hello")}
+	a.local(t, ot.Op{}.Insert("A").Retain(5))
+	b.local(t, ot.Op{}.Retain(5).Insert("B"))
+	if a.c.Seq() == b.c.Seq() {
+		t.Fatal("clients share sequence number", a.c.Seq())
+	}
+
+	for _, p := range []*peer{a, b} {
+		_, dup, err := f.ApplySeq(1, p.c.Seq(), p.ix, p.sent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dup {
+			t.Error("op of another client taken for a duplicate")
+		}
+	}
+	if cur := f.Current(); cur.Content != "AhelloB" {
+		t.Errorf("got %q", cur.Content)
+	}
+}
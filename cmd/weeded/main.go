@@ -10,6 +10,7 @@ import (
 	"strings"
 
 	"github.com/dane-unltd/weeded"
+	"github.com/dane-unltd/weeded/client"
 	"github.com/dane-unltd/weeded/ot"
 )
 
@@ -65,7 +66,10 @@ func main() {
 	enc := json.NewEncoder(conn)
 	out := Conn{0, enc}
 
-	out.Send("open", "/Users/david_neumann/test.txt")
+	out.Send("open", "test.txt")
+
+	var cl *client.Client
+	var doc []byte
 	for {
 		var msg weeded.Msg
 		err := dec.Decode(&msg)
@@ -75,15 +79,57 @@ func main() {
 		}
 		switch msg.ID {
 		case "buffer":
-			fmt.Println(string(*msg.Data))
-
-			op := ot.Operation{
-				Base:   -1,
-				OpType: ot.Insert,
-				Blocks: []ot.Block{{Pos: 3, Text: []byte("blabla")}},
+			var buf weeded.BufferMsg
+			err := json.Unmarshal(*msg.Data, &buf)
+			if err != nil {
+				lg.Println(err)
+				return
 			}
+			cl = client.New(buf.Ix)
+			doc = []byte(buf.Content)
+			fmt.Println(buf.Content)
 
-			out.Send("ot", op)
+			op := ot.Op{}.Insert("blabla").Retain(len(doc))
+			doc, err = op.ApplyTo(doc)
+			if err != nil {
+				lg.Println(err)
+				return
+			}
+			send, ix, err := cl.Local(op)
+			if err != nil {
+				lg.Println(err)
+				return
+			}
+			if send {
+				out.Send("ot", weeded.OtMsg{Ix: ix, Seq: cl.Seq(), Op: op})
+			}
+		case "ack":
+			send, ix, op, err := cl.Ack()
+			if err != nil {
+				lg.Println(err)
+				return
+			}
+			if send {
+				out.Send("ot", weeded.OtMsg{Ix: ix, Seq: cl.Seq(), Op: op})
+			}
+		case "ot":
+			var otmsg weeded.OtMsg
+			err := json.Unmarshal(*msg.Data, &otmsg)
+			if err != nil {
+				lg.Println(err)
+				return
+			}
+			op, err := cl.Remote(otmsg.Op)
+			if err != nil {
+				lg.Println(err)
+				return
+			}
+			doc, err = op.ApplyTo(doc)
+			if err != nil {
+				lg.Println(err)
+				return
+			}
+			fmt.Println(string(doc))
 		}
 	}
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// Access is the level of access a user has to a file.
+type Access int
+
+const (
+	NoAccess Access = iota
+	ReadAccess
+	WriteAccess
+)
+
+func (a Access) MarshalText() ([]byte, error) {
+	switch a {
+	case NoAccess:
+		return []byte("none"), nil
+	case ReadAccess:
+		return []byte("read"), nil
+	case WriteAccess:
+		return []byte("write"), nil
+	}
+	return nil, errors.New("unknown access level")
+}
+
+func (a *Access) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "none":
+		*a = NoAccess
+	case "read":
+		*a = ReadAccess
+	case "write":
+		*a = WriteAccess
+	default:
+		return errors.New("unknown access level " + string(text))
+	}
+	return nil
+}
+
+// Rule grants Access to the files matching the glob Path, which is relative
+// to the workspace root and separated by slashes. A rule for a directory
+// covers everything below it. Users holds user names, "@group" for all
+// members of a group and "*" for everybody, including anonymous users.
+type Rule struct {
+	Path   string
+	Users  []string
+	Access Access
+}
+
+// ACL decides which files users can read and write. The first rule
+// matching both user and path applies, Default if none does.
+type ACL struct {
+	Default Access
+	Groups  map[string][]string
+	Rules   []Rule
+}
+
+// acl is the access control list loaded with the -acl flag. Without one
+// everybody can write all files.
+var acl = &ACL{Default: WriteAccess}
+
+// LoadACL reads an ACL from a JSON file. Access levels are given as "none",
+// "read" or "write".
+func LoadACL(filename string) (*ACL, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	a := &ACL{Default: NoAccess}
+	err = json.Unmarshal(buf, a)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range a.Rules {
+		if _, err := path.Match(r.Path, ""); err != nil {
+			return nil, errors.New("bad pattern in acl: " + r.Path)
+		}
+	}
+	return a, nil
+}
+
+// Access returns the access of user to the file p, relative to the
+// workspace root.
+func (a *ACL) Access(user, p string) Access {
+	for _, r := range a.Rules {
+		if a.matchUser(r, user) && matchPath(r.Path, p) {
+			return r.Access
+		}
+	}
+	return a.Default
+}
+
+func (a *ACL) matchUser(r Rule, user string) bool {
+	for _, u := range r.Users {
+		switch {
+		case u == "*":
+			return true
+		case user == "":
+		case strings.HasPrefix(u, "@"):
+			for _, member := range a.Groups[u[1:]] {
+				if member == user {
+					return true
+				}
+			}
+		case u == user:
+			return true
+		}
+	}
+	return false
+}
+
+// matchPath reports whether pattern matches p or one of the directories
+// containing it.
+func matchPath(pattern, p string) bool {
+	for {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+		i := strings.LastIndex(p, "/")
+		if i < 0 {
+			return false
+		}
+		p = p[:i]
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestACL(t *testing.T) {
+	a := &ACL{
+		Default: ReadAccess,
+		Groups:  map[string][]string{"dev": {"ann", "bob"}},
+		Rules: []Rule{
+			{Path: "src/vendor", Users: []string{"*"}, Access: ReadAccess},
+			{Path: "src", Users: []string{"@dev"}, Access: WriteAccess},
+			{Path: "*.md", Users: []string{"cat"}, Access: WriteAccess},
+			{Path: "secret", Users: []string{"*"}, Access: NoAccess},
+			{Path: "secret/*.pub", Users: []string{"*"}, Access: ReadAccess},
+		},
+	}
+	tests := []struct {
+		user, path string
+		want       Access
+	}{
+		// rules for a directory cover everything below it
+		{"ann", "src", WriteAccess},
+		{"bob", "src/main.go", WriteAccess},
+		{"bob", "src/cmd/main.go", WriteAccess},
+		{"bob", "srcfile", ReadAccess},
+		// the first matching rule applies
+		{"ann", "src/vendor/lib.go", ReadAccess},
+		{"ann", "secret/key.pub", NoAccess},
+		// users outside the group and anonymous users fall through
+		{"cat", "src/main.go", ReadAccess},
+		{"", "src/main.go", ReadAccess},
+		{"cat", "README.md", WriteAccess},
+		{"cat", "doc/README.md", ReadAccess},
+		{"", "secret", NoAccess},
+		{"", "secret/key", NoAccess},
+		{"dan", "notes.txt", ReadAccess},
+	}
+	for _, test := range tests {
+		if got := a.Access(test.user, test.path); got != test.want {
+			t.Errorf("%q on %s: got %v, want %v", test.user, test.path, got, test.want)
+		}
+	}
+}
+
+func TestLoadACL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weededd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "acl.json")
+
+	err = ioutil.WriteFile(name, []byte(`{"Rules": [{"Path": "docs", "Users": ["*"], "Access": "write"}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := LoadACL(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Access("", "docs/a.txt") != WriteAccess || a.Access("ann", "a.txt") != NoAccess {
+		t.Error("unexpected access", a)
+	}
+
+	for _, bad := range []string{
+		`{"Rules": [{"Path": "[", "Users": ["*"], "Access": "read"}]}`,
+		`{"Rules": [{"Path": "docs", "Users": ["*"], "Access": "all"}]}`,
+	} {
+		err = ioutil.WriteFile(name, []byte(bad), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = LoadACL(name); err == nil {
+			t.Error("loaded", bad)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+
+	"github.com/dane-unltd/weeded"
+	"github.com/dane-unltd/weeded/ot"
+)
+
+// requestError is a failed request together with the code reported to the
+// client.
+type requestError struct {
+	code weeded.ErrorCode
+	msg  string
+}
+
+func (e *requestError) Error() string {
+	return e.msg
+}
+
+func reqError(code weeded.ErrorCode, msg string) error {
+	return &requestError{code: code, msg: msg}
+}
+
+// errorMsg classifies err for the client. Rejected ops carry the revision
+// they were based on.
+func errorMsg(err error) weeded.ErrorMsg {
+	msg := weeded.ErrorMsg{Code: weeded.CodeInternal, Message: err.Error(), Ix: -1}
+	var re *requestError
+	var oe *weeded.OpError
+	if errors.As(err, &oe) {
+		msg.Code = weeded.CodeBadOp
+		msg.Ix = oe.Ix
+	}
+	switch {
+	case errors.As(err, &re):
+		msg.Code = re.code
+	case errors.Is(err, ot.ErrTooLarge):
+		msg.Code = weeded.CodeLimit
+	case errors.Is(err, weeded.ErrCompacted):
+		msg.Code = weeded.CodeCompacted
+	case oe != nil:
+		// any other reason to reject an op
+	case errors.Is(err, weeded.ErrModifiedOnDisk):
+		msg.Code = weeded.CodeConflict
+	case errors.Is(err, fs.ErrNotExist):
+		msg.Code = weeded.CodeNotFound
+	case errors.Is(err, fs.ErrExist):
+		msg.Code = weeded.CodeExists
+	case errors.Is(err, fs.ErrPermission):
+		msg.Code = weeded.CodePermission
+	}
+	return msg
+}
+
+// sendError reports a failed request to the connection which sent it.
+// Internal errors are logged as well.
+func sendError(conn Conn, err error) {
+	msg := errorMsg(err)
+	if msg.Code == weeded.CodeInternal {
+		lg.Println(err)
+	}
+	send(conn, "error", msg)
+}
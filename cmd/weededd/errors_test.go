@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/dane-unltd/weeded"
+	"github.com/dane-unltd/weeded/ot"
+)
+
+func TestErrorMsg(t *testing.T) {
+	_, notExist := os.Open("/nonexistent/weededd")
+	tests := []struct {
+		err  error
+		code weeded.ErrorCode
+		ix   int64
+	}{
+		{reqError(weeded.CodeUnknownDocument, "unknown document"), weeded.CodeUnknownDocument, -1},
+		{&weeded.OpError{Ix: 4, Err: &ot.InvalidOpError{SubOp: 1, Err: ot.ErrDeleteMismatch}}, weeded.CodeBadOp, 4},
+		{&weeded.OpError{Ix: 5, Err: &ot.InvalidOpError{SubOp: -1, Err: ot.ErrDocTooLarge}}, weeded.CodeLimit, 5},
+		{&weeded.OpError{Ix: 6, Err: limitError("op_rate", "too many ops")}, weeded.CodeLimit, 6},
+		{&weeded.OpError{Ix: 7, Err: weeded.ErrCompacted}, weeded.CodeCompacted, 7},
+		{fmt.Errorf("saving: %w", weeded.ErrModifiedOnDisk), weeded.CodeConflict, -1},
+		{fmt.Errorf("%w, cannot merge: revision 3: %v", weeded.ErrModifiedOnDisk, weeded.ErrCompacted), weeded.CodeConflict, -1},
+		{notExist, weeded.CodeNotFound, -1},
+		{os.ErrExist, weeded.CodeExists, -1},
+		{os.ErrPermission, weeded.CodePermission, -1},
+		{fmt.Errorf("disk on fire"), weeded.CodeInternal, -1},
+	}
+	for _, test := range tests {
+		msg := errorMsg(test.err)
+		if msg.Code != test.code || msg.Ix != test.ix || msg.Message != test.err.Error() {
+			t.Errorf("%v: got %+v, want code %q at %d", test.err, msg, test.code, test.ix)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/dane-unltd/weeded"
+	"github.com/dane-unltd/weeded/ot"
+)
+
+// Limits of the daemon, as set by flags. Zero disables a limit.
+var (
+	// maxDocSize and maxOpSize bound the bytes of a document and of
+	// the text an op inserts and deletes.
+	maxDocSize int
+	maxOpSize  int
+	// opRate is the number of ops per second a connection may send on
+	// average, in bursts of up to opBurst ops.
+	opRate  float64
+	opBurst int
+	// maxConns is the number of connections a user may hold at once.
+	maxConns int
+)
+
+// limitHits counts the requests rejected by every limit. It is served with
+// the other metrics on the address given with -metrics.
+var limitHits = expvar.NewMap("limits")
+
+// fileLimits returns the limits for the ops applied to a file.
+func fileLimits() ot.Limits {
+	return ot.Limits{MaxOpSize: maxOpSize, MaxDocSize: maxDocSize}
+}
+
+// limitError reports a request rejected by the limit name.
+func limitError(name, msg string) error {
+	limitHits.Add(name, 1)
+	return reqError(weeded.CodeLimit, msg)
+}
+
+// countTooLarge records an op rejected for its size.
+func countTooLarge(err error) {
+	switch {
+	case errors.Is(err, ot.ErrDocTooLarge):
+		limitHits.Add("doc_size", 1)
+	case errors.Is(err, ot.ErrOpTooLarge):
+		limitHits.Add("op_size", 1)
+	}
+}
+
+// bucket is a token bucket granting rate tokens per second, holding at most
+// burst of them.
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64, burst int) *bucket {
+	return &bucket{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// take reports whether n tokens are left at now and uses them up. A bucket
+// with a rate of zero never runs out.
+func (b *bucket) take(now time.Time, n int) bool {
+	if b.rate <= 0 {
+		return true
+	}
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// userConns counts the connections of every identified user.
+var userConns = struct {
+	mu sync.Mutex
+	n  map[string]int
+}{n: make(map[string]int)}
+
+// addConn registers a connection of user unless the user already holds
+// maxConns connections.
+func addConn(user string) bool {
+	userConns.mu.Lock()
+	defer userConns.mu.Unlock()
+	if maxConns > 0 && userConns.n[user] >= maxConns {
+		return false
+	}
+	userConns.n[user]++
+	return true
+}
+
+func removeConn(user string) {
+	userConns.mu.Lock()
+	defer userConns.mu.Unlock()
+	userConns.n[user]--
+	if userConns.n[user] <= 0 {
+		delete(userConns.n, user)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	now := time.Now()
+	b := newBucket(10, 3)
+
+	// a full bucket allows a burst
+	for i := 0; i < 3; i++ {
+		if !b.take(now, 1) {
+			t.Fatal("burst refused after", i)
+		}
+	}
+	if b.take(now, 1) {
+		t.Fatal("burst beyond its size")
+	}
+
+	// tokens come back at the rate, but never more than the burst
+	now = now.Add(150 * time.Millisecond)
+	if !b.take(now, 1) || b.take(now, 1) {
+		t.Error("unexpected tokens after 150ms")
+	}
+	now = now.Add(time.Hour)
+	if b.take(now, 4) || !b.take(now, 3) {
+		t.Error("unexpected tokens after an hour")
+	}
+
+	unlimited := newBucket(0, 0)
+	for i := 0; i < 1000; i++ {
+		if !unlimited.take(now, 5) {
+			t.Fatal("bucket without rate ran out")
+		}
+	}
+}
+
+func TestUserConns(t *testing.T) {
+	defer func(n int) { maxConns = n }(maxConns)
+	maxConns = 2
+
+	if !addConn("ann") || !addConn("ann") || !addConn("bob") {
+		t.Fatal("connections below the limit refused")
+	}
+	if addConn("ann") {
+		t.Error("connection beyond the limit")
+	}
+	removeConn("ann")
+	if !addConn("ann") {
+		t.Error("connection refused after another one was closed")
+	}
+	removeConn("ann")
+	removeConn("ann")
+	removeConn("bob")
+	if len(userConns.n) != 0 {
+		t.Error("users without connections kept", userConns.n)
+	}
+
+	maxConns = 0
+	for i := 0; i < 10; i++ {
+		if !addConn("ann") {
+			t.Fatal("connection refused without limit")
+		}
+	}
+	for i := 0; i < 10; i++ {
+		removeConn("ann")
+	}
+}
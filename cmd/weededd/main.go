@@ -1,155 +1,668 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
+	"hash/fnv"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
-	"github.com/dane-unltd/msglog"
 	"github.com/dane-unltd/weeded"
-	"github.com/dane-unltd/weeded/ot"
 )
 
 var lg *log.Logger
 var root string
 
+// openStore opens the op store of a file, as selected by the -store flag.
+var openStore func(filename string) (weeded.OpStore, error)
+var storeName string
+
 func init() {
 	lg = log.New(os.Stderr, "Error: ", 0)
 }
 
 func main() {
+	store := flag.String("store", "msglog", "op store for open files: msglog, flat or mem")
+	flag.StringVar(&root, "root", ".", "workspace root all paths are relative to")
+	aclFile := flag.String("acl", "", "JSON file with the access control list")
+	flag.DurationVar(&autosaveIdle, "autosave", 10*time.Second, "save buffers idle for this long, 0 to disable")
+	flag.IntVar(&autosaveOps, "autosave-ops", 200, "save buffers after this many unsaved ops, 0 to disable")
+	flag.IntVar(&maxDocSize, "max-doc", 16<<20, "largest document in bytes ops may produce, 0 for no limit")
+	flag.IntVar(&maxOpSize, "max-op", 1<<20, "most bytes an op may insert and delete, 0 for no limit")
+	flag.Float64Var(&opRate, "op-rate", 100, "ops per second a connection may send on average, 0 for no limit")
+	flag.IntVar(&opBurst, "op-burst", 200, "ops a connection may send at once")
+	flag.IntVar(&maxConns, "max-conns", 16, "connections a user may hold at once, 0 for no limit")
+	metricsAddr := flag.String("metrics", "", "address to serve metrics on at /debug/vars")
+	flag.Parse()
+
+	var err error
+	openStore, err = storeOpener(*store)
+	if err != nil {
+		lg.Fatalln(err)
+	}
+	storeName = *store
+	root, err = filepath.Abs(root)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		lg.Fatalln(err)
+	}
+	if *aclFile != "" {
+		acl, err = LoadACL(*aclFile)
+		if err != nil {
+			lg.Fatalln(err)
+		}
+	}
+
 	addr := "/tmp/weeded.sock"
 	netw := "unix"
-	if len(os.Args) >= 2 {
-		strs := strings.SplitN(os.Args[1], ":", 2)
+	if flag.NArg() >= 1 {
+		strs := strings.SplitN(flag.Arg(0), ":", 2)
 		if len(strs) == 1 {
 			addr = strs[0]
 		} else {
 			addr = strs[1]
 			netw = strs[0]
 		}
-		var err error
 		addr, err = filepath.Abs(addr)
 		if err != nil {
 			lg.Fatalln(err)
 		}
 	}
 
+	if *metricsAddr != "" {
+		go func() {
+			lg.Println(http.ListenAndServe(*metricsAddr, nil))
+		}()
+	}
+
+	err = recoverFiles()
+	if err != nil {
+		lg.Println(err)
+	}
+
 	ln, err := net.Listen(netw, addr)
 	if err != nil {
 		lg.Fatalln(err)
 	}
 
-	aq := make(chan *Aquire)
+	// the first signal shuts down gracefully, a second one right away
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		ln.Close()
+		<-sigs
+		lg.Println("shutting down without waiting for clients")
+		os.Exit(1)
+	}()
+
+	ws := NewWorkspace()
 
-	go manageBuffers(aq)
+	go ws.Run()
 
+	var clients sync.WaitGroup
+	var id uint64
 	for {
-		var uid int
 		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			break
+		}
 		if err != nil {
 			lg.Println(err)
+			continue
 		}
-		uid++
-		go handleClient(conn, uid, aq)
+		id++
+		clients.Add(1)
+		go func(conn net.Conn, id uint64) {
+			defer clients.Done()
+			handleClient(conn, id, ws)
+		}(conn, id)
 	}
+	ws.Shutdown()
+	clients.Wait()
 }
 
-type Encoder interface {
-	Encode(v interface{}) error
+func storeOpener(name string) (func(filename string) (weeded.OpStore, error), error) {
+	switch name {
+	case "msglog":
+		return func(filename string) (weeded.OpStore, error) {
+			return weeded.NewMsglogStore(filename)
+		}, nil
+	case "flat":
+		return func(filename string) (weeded.OpStore, error) {
+			return weeded.NewFlatStore(filename)
+		}, nil
+	case "mem":
+		// only accessed by Workspace.Run
+		stores := make(map[string]*weeded.MemStore)
+		return func(filename string) (weeded.OpStore, error) {
+			store, ok := stores[filename]
+			if !ok {
+				store = weeded.NewMemStore()
+				stores[filename] = store
+			}
+			return store, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown store %q", name)
 }
 
+// Conn is a connected client, or one of the documents it opened. id
+// identifies the connection, uid the author of its ops. Anonymous
+// connections use their id as uid, connections of a user sent with
+// "identify" share the uid of the user.
 type Conn struct {
-	uid int
-	enc Encoder
+	id  uint64
+	uid uint64
+	// user is the name access is checked for, empty for anonymous users.
+	user string
+	// doc is the document messages sent with the Conn refer to.
+	doc uint64
+	q   *sendQueue
 }
 
+// Send queues a message for the connection without blocking.
 func (c Conn) Send(id weeded.MsgID, data interface{}) error {
-	return c.enc.Encode(struct {
-		ID   weeded.MsgID
-		Data interface{}
-	}{id, data})
+	return c.q.send(outMsg{id: id, doc: c.doc, data: data})
 }
 
+// pollInterval is the time between checks for modifications made to open
+// files on disk.
+const pollInterval = 2 * time.Second
+
+// compactInterval is the number of ops after which a buffer drops the part
+// of the op log no connected user can reference anymore.
+const compactInterval = 1000
+
+// A buffer is saved once no op has been applied for autosaveIdle, or after
+// autosaveOps unsaved ops. Zero disables either, as set by the -autosave and
+// -autosave-ops flags.
+var autosaveIdle time.Duration
+var autosaveOps int
+
 type Buffer struct {
-	b          *ot.Buffer
-	ots        chan *ot.Operation
-	connect    chan Conn
+	f          *weeded.File
+	path       string
+	ots        chan otReq
+	cursors    chan cursorReq
+	hists      chan histReq
+	blames     chan Conn
+	saves      chan Conn
+	connect    chan connectReq
 	disconnect chan Conn
-	nUsers     int
+	quit       chan chan struct{}
+	// done is closed once the buffer is closed, requests sent later are
+	// dropped.
+	done   chan struct{}
+	nUsers int
 }
 
 func NewBuffer(file string) (*Buffer, error) {
-	f, err := ioutil.ReadFile(file)
+	store, err := openStore(file)
 	if err != nil {
 		return nil, err
 	}
+	f, err := weeded.OpenFile(file, store)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	f.SetLimits(fileLimits())
 	return &Buffer{
-		b:          ot.NewBuffer(f),
-		ots:        make(chan *ot.Operation),
-		connect:    make(chan Conn),
+		f:          f,
+		path:       relPath(file),
+		ots:        make(chan otReq),
+		cursors:    make(chan cursorReq),
+		hists:      make(chan histReq),
+		blames:     make(chan Conn),
+		saves:      make(chan Conn),
+		connect:    make(chan connectReq),
 		disconnect: make(chan Conn),
+		quit:       make(chan chan struct{}),
+		done:       make(chan struct{}),
 	}, nil
 }
 
+// Run serializes all access to the buffer. Every accepted op is acknowledged
+// to its author and broadcast to all other users of the buffer. Cursors are
+// kept up to date with the latest revision, so users connecting later
+// receive them as well. All users are told the revision last saved to disk
+// whenever it changes.
 func (b *Buffer) Run() {
-	users := make(map[int]Conn)
+	// users, cursors and bases are keyed by connection id.
+	users := make(map[uint64]Conn)
+	cursors := make(map[uint64]weeded.CursorMsg)
+	// bases holds the oldest revision each connection can still base an
+	// op on.
+	bases := make(map[uint64]int64)
+	cur := b.f.Current()
+	rev, saved := cur.Ix, cur.Saved
+	nOps := 0
+	// unsaved counts the ops applied since the last save at lastOp.
+	unsaved := 0
+	var lastOp time.Time
+	// conflict is set while a modification on disk cannot be merged.
+	conflict := false
+
+	// publish distributes an op which has been applied to the file. It is
+	// acknowledged to the connection with id from.
+	publish := func(otmsg weeded.OtMsg, from uint64) {
+		rev = otmsg.Ix + 1
+		for id, cur := range cursors {
+			cur.Sel = cur.Sel.Transform(otmsg.Op)
+			cur.Ix = rev
+			cursors[id] = cur
+		}
+		if conn, ok := users[from]; ok {
+			send(conn, "ack", otmsg.Ix)
+		}
+		broadcast(users, from, "ot", otmsg)
+	}
+
+	// setSaved records the revision on disk.
+	setSaved := func(ix int64) {
+		unsaved = 0
+		if ix != saved {
+			saved = ix
+			broadcast(users, 0, "saved", ix)
+		}
+	}
+
+	// save merges modifications made on disk and writes the buffer.
+	save := func() (int64, error) {
+		otmsg, ok, err := b.f.Reload()
+		if err != nil {
+			return saved, err
+		}
+		if ok {
+			publish(otmsg, 0)
+		}
+		ix, err := b.f.Save()
+		if err != nil {
+			return saved, err
+		}
+		setSaved(ix)
+		return ix, nil
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
 	for {
 		select {
-		case op := <-b.ots:
-			b.b.Apply(*op)
-		case conn := <-b.connect:
-			users[conn.uid] = conn
-			conn.Send("buffer", string(b.b.Current))
+		case req := <-b.ots:
+			id := req.conn.id
+			if req.msg.Ix > bases[id] {
+				bases[id] = req.msg.Ix
+			}
+			otmsg, dup, err := b.f.ApplySeq(req.conn.uid, req.msg.Seq, req.msg.Ix, req.msg.Op)
+			if err != nil {
+				countTooLarge(err)
+				sendError(req.conn, err)
+				continue
+			}
+			if dup {
+				// sent again after a timeout
+				send(req.conn, "ack", otmsg.Ix)
+				continue
+			}
+			publish(otmsg, id)
+
+			unsaved++
+			lastOp = time.Now()
+			if autosaveOps > 0 && unsaved >= autosaveOps {
+				_, err = save()
+				if err != nil {
+					lg.Println(err)
+				}
+			}
+
+			nOps++
+			if nOps >= compactInterval {
+				nOps = 0
+				// the revision on disk is kept to merge modifications
+				// made by other programs
+				keep := rev
+				if saved >= 0 && saved < keep {
+					keep = saved
+				}
+				for _, base := range bases {
+					if base < keep {
+						keep = base
+					}
+				}
+				err = b.f.Compact(keep)
+				if err != nil {
+					lg.Println(err)
+				}
+			}
+		case <-ticker.C:
+			if unsaved > 0 && autosaveIdle > 0 && time.Since(lastOp) >= autosaveIdle {
+				_, err := save()
+				if err != nil {
+					lg.Println(err)
+				}
+				continue
+			}
+			otmsg, ok, err := b.f.Reload()
+			if err != nil {
+				msg := errorMsg(err)
+				if msg.Code != weeded.CodeConflict {
+					lg.Println(err)
+				} else if !conflict {
+					// told once, saving reports it again
+					conflict = true
+					broadcast(users, 0, "error", msg)
+				}
+				continue
+			}
+			conflict = false
+			if ok {
+				// no connection has id 0
+				publish(otmsg, 0)
+				// the merged buffer has been written
+				setSaved(rev)
+			}
+		case conn := <-b.saves:
+			ix, err := save()
+			if err != nil {
+				sendError(conn, err)
+				continue
+			}
+			send(conn, "save", ix)
+		case req := <-b.cursors:
+			cur := req.cur
+			cur.UID = req.conn.uid
+			if cur.Ix < rev {
+				otmsgs, err := b.f.History(cur.Ix, rev)
+				if err != nil {
+					sendError(req.conn, err)
+					continue
+				}
+				for _, otmsg := range otmsgs {
+					cur.Sel = cur.Sel.Transform(otmsg.Op)
+				}
+				cur.Ix = rev
+			}
+			cursors[req.conn.id] = cur
+			broadcast(users, req.conn.id, "cursor", cur)
+		case req := <-b.hists:
+			hist, err := b.history(req.msg, rev)
+			if err != nil {
+				sendError(req.conn, err)
+				continue
+			}
+			send(req.conn, "history", hist)
+		case conn := <-b.blames:
+			lines, err := b.f.Blame()
+			if err != nil {
+				sendError(conn, err)
+				continue
+			}
+			send(conn, "blame", weeded.BlameMsg{Ix: rev, Lines: lines})
+		case req := <-b.connect:
+			conn := req.conn
+			resumed := false
+			if req.resume != nil {
+				res := req.resume
+				remote, applied, err := b.f.Resume(conn.uid, res.Ix, res.Ops, res.Seqs)
+				for _, otmsg := range applied {
+					// conn is not among the users yet, so its
+					// ops are not acknowledged
+					publish(otmsg, conn.id)
+					unsaved++
+					lastOp = time.Now()
+				}
+				if err == nil {
+					send(conn, "resume", weeded.ResumeMsg{Path: b.path, Ix: rev, Ops: remote, Saved: saved})
+					resumed = true
+				} else {
+					// the client rebases its ops on the buffer
+					// sent instead
+					countTooLarge(err)
+					sendError(conn, err)
+				}
+			}
+			users[conn.id] = conn
+			bases[conn.id] = rev
+			if !resumed {
+				buf := b.f.Current()
+				buf.Path = b.path
+				send(conn, "buffer", buf)
+			}
+			for _, cur := range cursors {
+				send(conn, "cursor", cur)
+			}
 		case conn := <-b.disconnect:
-			delete(users, conn.uid)
+			delete(users, conn.id)
+			delete(bases, conn.id)
+			if _, ok := cursors[conn.id]; ok {
+				delete(cursors, conn.id)
+				if !hasCursor(cursors, conn.uid) {
+					broadcast(users, conn.id, "leave", conn.uid)
+				}
+			}
+		case ret := <-b.quit:
+			b.f.Close()
+			close(b.done)
+			ret <- struct{}{}
+			return
 		}
 	}
 }
 
-func (b *Buffer) Apply(op *ot.Operation) {
-	b.ots <- op
+// history fills in the content and ops of a history request. A missing or
+// too large upper bound is replaced by the current revision rev.
+func (b *Buffer) history(hist weeded.HistoryMsg, rev int64) (weeded.HistoryMsg, error) {
+	if hist.To <= 0 || hist.To > rev {
+		hist.To = rev
+	}
+	content, err := b.f.At(hist.From)
+	if err != nil {
+		return hist, err
+	}
+	hist.Content = string(content)
+	hist.Ops, err = b.f.History(hist.From, hist.To)
+	return hist, err
+}
+
+func send(conn Conn, id weeded.MsgID, data interface{}) {
+	err := conn.Send(id, data)
+	if err != nil {
+		lg.Println(err)
+	}
+}
+
+// broadcast sends a message to all users except the connection from.
+func broadcast(users map[uint64]Conn, from uint64, id weeded.MsgID, data interface{}) {
+	for cid, conn := range users {
+		if cid != from {
+			send(conn, id, data)
+		}
+	}
+}
+
+// hasCursor reports whether another connection of the user uid still shares
+// a cursor.
+func hasCursor(cursors map[uint64]weeded.CursorMsg, uid uint64) bool {
+	for _, cur := range cursors {
+		if cur.UID == uid {
+			return true
+		}
+	}
+	return false
+}
+
+type otReq struct {
+	conn Conn
+	msg  weeded.OtMsg
+}
+
+func (b *Buffer) Apply(conn Conn, otmsg weeded.OtMsg) {
+	select {
+	case b.ots <- otReq{conn: conn, msg: otmsg}:
+	case <-b.done:
+	}
+}
+
+// connectReq adds conn to the users of a buffer. With resume set, the
+// buffer is resumed from the revision of a lost connection instead of being
+// sent in full.
+type connectReq struct {
+	conn   Conn
+	resume *weeded.ResumeMsg
+}
+
+type cursorReq struct {
+	conn Conn
+	cur  weeded.CursorMsg
+}
+
+func (b *Buffer) Cursor(conn Conn, cur weeded.CursorMsg) {
+	select {
+	case b.cursors <- cursorReq{conn: conn, cur: cur}:
+	case <-b.done:
+	}
+}
+
+// Close writes the file and closes its op log.
+func (b *Buffer) Close() {
+	ret := make(chan struct{})
+	b.quit <- ret
+	<-ret
+}
+
+type histReq struct {
+	conn Conn
+	msg  weeded.HistoryMsg
+}
+
+func (b *Buffer) History(conn Conn, hist weeded.HistoryMsg) {
+	select {
+	case b.hists <- histReq{conn: conn, msg: hist}:
+	case <-b.done:
+	}
+}
+
+func (b *Buffer) Blame(conn Conn) {
+	select {
+	case b.blames <- conn:
+	case <-b.done:
+	}
+}
+
+// Save writes the buffer to disk. conn receives the revision saved.
+func (b *Buffer) Save(conn Conn) {
+	select {
+	case b.saves <- conn:
+	case <-b.done:
+	}
 }
 
+// Aquire opens the file f for conn, or releases it if release is set. With
+// f nil all files of conn are released, as it has been closed. A set resume
+// resumes the buffer instead of sending it in full.
 type Aquire struct {
-	f   *string
-	UID uint64
-	ret chan<- *msglog.Consumer
+	f       *string
+	release bool
+	resume  *weeded.ResumeMsg
+	conn    Conn
+	ret     chan<- *Buffer
 }
 
-func manageBuffers(aq chan *Aquire) {
+// Run keeps track of the open buffers and of all connections, which are
+// notified about changes to the tree. A buffer stays open as long as a
+// connection holds it. After Shutdown, Run goes on to let the remaining
+// connections leave, but no file is opened or changed anymore.
+func (ws *Workspace) Run() {
 	buffers := make(map[string]*Buffer)
-	files := make(map[int]string)
+	// files holds the names of the files each connection holds.
+	files := make(map[uint64]map[string]bool)
+	conns := make(map[uint64]Conn)
+	closing := false
 
-	for {
-		req := <-aq
+	release := func(conn Conn, name string) {
+		if !files[conn.id][name] {
+			return
+		}
+		delete(files[conn.id], name)
+		buf := buffers[name]
+		buf.nUsers--
+		buf.disconnect <- conn
+		if buf.nUsers == 0 {
+			delete(buffers, name)
+			buf.Close()
+		}
+	}
 
-		if req.f == nil {
-			name, ok := files[req.conn.uid]
-			if !ok {
+	for {
+		var req *Aquire
+		select {
+		case conn := <-ws.join:
+			conns[conn.id] = conn
+			if closing {
+				send(conn, "shutdown", nil)
+				conn.q.flush()
+			}
+			continue
+		case treq := <-ws.tree:
+			if closing {
+				sendError(treq.conn, errShutdown)
 				continue
 			}
-			buf, ok := buffers[name]
-			if !ok {
+			msg, err := changeTree(treq.msg, treq.conn.user, buffers)
+			if err != nil {
+				sendError(treq.conn, err)
 				continue
 			}
-			buf.nUsers--
-			buf.disconnect <- req.conn
-			delete(files, req.conn.uid)
-
-			fmt.Println("disconnecting:", req.conn.uid)
-			if buf.nUsers == 0 {
+			for _, conn := range conns {
+				send(conn, "tree", msg)
+			}
+			continue
+		case ret := <-ws.shutdown:
+			for _, conn := range conns {
+				send(conn, "shutdown", nil)
+			}
+			for name, buf := range buffers {
+				buf.Close()
 				delete(buffers, name)
-				err := ioutil.WriteFile(name, buf.b.Current, 0744)
-				if err != nil {
-					lg.Println(err)
-				}
 			}
+			// the buffers are gone, so there is nothing to release
+			files = make(map[uint64]map[string]bool)
+			for _, conn := range conns {
+				conn.q.flush()
+			}
+			closing = true
+			ret <- struct{}{}
+			continue
+		case req = <-ws.aq:
+		}
+
+		if req.f == nil {
+			for name := range files[req.conn.id] {
+				release(req.conn, name)
+			}
+			delete(files, req.conn.id)
+			delete(conns, req.conn.id)
+			fmt.Println("disconnecting:", req.conn.id)
+			continue
+		}
+		if req.release {
+			release(req.conn, *req.f)
+			continue
+		}
+		if closing {
+			req.ret <- nil
 			continue
 		}
 
@@ -160,56 +673,296 @@ func manageBuffers(aq chan *Aquire) {
 			buf, err = NewBuffer(*req.f)
 			if err != nil {
 				lg.Println(err)
+				req.ret <- nil
 				continue
 			}
 
 			go buf.Run()
 			buffers[*req.f] = buf
 		}
-		files[req.conn.uid] = *req.f
+		if files[req.conn.id] == nil {
+			files[req.conn.id] = make(map[string]bool)
+		}
+		if !files[req.conn.id][*req.f] {
+			files[req.conn.id][*req.f] = true
+			buf.nUsers++
+		}
 
-		buf.nUsers++
-		buf.connect <- req.conn
+		// opening a file again sends the buffer again
+		buf.connect <- connectReq{conn: req.conn, resume: req.resume}
 		req.ret <- buf
 	}
 }
 
-func handleClient(conn net.Conn, uid int, aq chan *Aquire) {
-	dec := json.NewDecoder(conn)
-	wconn := Conn{uid: uid, enc: json.NewEncoder(conn)}
-	var buf *Buffer
+// openDoc is a document opened by a connection.
+type openDoc struct {
+	path   string
+	buf    *Buffer
+	conn   Conn
+	access Access
+}
+
+// canIdentify reports whether a client may identify its user on conn. Only
+// unix sockets qualify, as their file permissions restrict who can connect.
+// Clients connecting over the network stay anonymous.
+func canIdentify(conn net.Conn) bool {
+	return conn.LocalAddr().Network() == "unix"
+}
+
+func handleClient(conn net.Conn, id uint64, ws *Workspace) {
+	r := weeded.NewMsgReader(conn)
+	wconn := Conn{id: id, uid: id, q: newSendQueue(conn)}
+	docs := make(map[uint64]*openDoc)
+	paths := make(map[string]uint64)
+	var nextDoc uint64
+	codec := weeded.CodecJSON
+	rate := newBucket(opRate, opBurst)
+
+	defer wconn.q.close()
+	ws.Join(wconn)
+	defer func() { ws.aq <- &Aquire{conn: wconn} }()
+
+	// lookup returns the document a message refers to. Messages without
+	// a document refer to the only open one.
+	lookup := func(msg weeded.Msg) *openDoc {
+		if msg.Doc == 0 && len(docs) == 1 {
+			for _, d := range docs {
+				return d
+			}
+		}
+		d, ok := docs[msg.Doc]
+		if !ok {
+			c := wconn
+			c.doc = msg.Doc
+			sendError(c, reqError(weeded.CodeUnknownDocument, fmt.Sprintf("unknown document %d", msg.Doc)))
+		}
+		return d
+	}
+
+	// access resolves a path to open and checks the user can read it.
+	access := func(p string) (string, Access, error) {
+		f, err := resolve(p)
+		if err != nil {
+			return "", NoAccess, err
+		}
+		a := acl.Access(wconn.user, relPath(f))
+		if a < ReadAccess {
+			return "", NoAccess, reqError(weeded.CodePermission, "permission denied: "+relPath(f))
+		}
+		return f, a, nil
+	}
 
-	defer func() { aq <- &Aquire{conn: wconn} }()
+	// open aquires the buffer of d, resuming it with res if set.
+	open := func(d *openDoc, res *weeded.ResumeMsg) {
+		ret := make(chan (*Buffer))
+		ws.aq <- &Aquire{f: &d.path, resume: res, conn: d.conn, ret: ret}
+		d.buf = <-ret
+		if d.buf == nil {
+			sendError(wconn, errors.New("cannot open "+relPath(d.path)))
+			return
+		}
+		docs[d.conn.doc] = d
+		paths[d.path] = d.conn.doc
+	}
 
 	for {
-		var msg weeded.Msg
-		err := dec.Decode(&msg)
+		msg, err := r.Receive()
 		if err != nil {
 			lg.Println(err)
 			return
 		}
 		switch msg.ID {
-		case "ot":
-			var op ot.Operation
-			err := json.Unmarshal(*msg.Data, &op)
-			op.UID = uid
+		case "codec":
+			// the codec can only be switched before a document is
+			// opened, as nothing else is sent to the connection yet
+			var req string
+			err := msg.Decode(&req)
+			if err != nil {
+				sendError(wconn, reqError(weeded.CodeBadRequest, err.Error()))
+				continue
+			}
+			if len(docs) == 0 && r.SetCodec(req) == nil {
+				codec = req
+			}
+			err = wconn.q.send(outMsg{id: "codec", data: codec, codec: codec})
 			if err != nil {
 				lg.Println(err)
+			}
+		case "identify":
+			// the identity of a connection is only set before a
+			// document is opened, by a client trusted with the socket
+			if !canIdentify(conn) {
+				sendError(wconn, reqError(weeded.CodePermission, "identify is only accepted on unix sockets"))
+				continue
+			}
+			var user string
+			err := msg.Decode(&user)
+			if err != nil {
+				sendError(wconn, reqError(weeded.CodeBadRequest, err.Error()))
+				continue
+			}
+			if len(docs) > 0 || wconn.user != "" || user == "" {
+				sendError(wconn, reqError(weeded.CodeBadRequest, "cannot identify as "+user))
+				continue
+			}
+			if !addConn(user) {
+				sendError(wconn, limitError("connections", "too many connections of "+user))
 				return
 			}
-			if buf != nil {
-				buf.Apply(&op)
+			defer removeConn(user)
+			wconn.user = user
+			wconn.uid = userUID(user)
+			send(wconn, "identify", wconn.uid)
+		case "ot":
+			var otmsg weeded.OtMsg
+			err := msg.Decode(&otmsg)
+			if err != nil {
+				sendError(wconn, reqError(weeded.CodeBadRequest, err.Error()))
+				continue
+			}
+			d := lookup(msg)
+			if d == nil {
+				continue
+			}
+			if d.access < WriteAccess {
+				sendError(d.conn, reqError(weeded.CodeReadOnly, "read-only file"))
+				continue
+			}
+			if !rate.take(time.Now(), 1) {
+				sendError(d.conn, &weeded.OpError{Ix: otmsg.Ix, Err: limitError("op_rate", "too many ops, slow down")})
+				continue
+			}
+			d.buf.Apply(d.conn, otmsg)
+		case "cursor":
+			var cur weeded.CursorMsg
+			err := msg.Decode(&cur)
+			if err != nil {
+				sendError(wconn, reqError(weeded.CodeBadRequest, err.Error()))
+				continue
+			}
+			if d := lookup(msg); d != nil {
+				d.buf.Cursor(d.conn, cur)
+			}
+		case "history":
+			var hist weeded.HistoryMsg
+			err := msg.Decode(&hist)
+			if err != nil {
+				sendError(wconn, reqError(weeded.CodeBadRequest, err.Error()))
+				continue
+			}
+			if d := lookup(msg); d != nil {
+				d.buf.History(d.conn, hist)
+			}
+		case "blame":
+			if d := lookup(msg); d != nil {
+				d.buf.Blame(d.conn)
+			}
+		case "save":
+			if d := lookup(msg); d != nil {
+				d.buf.Save(d.conn)
 			}
+		case "close":
+			d := lookup(msg)
+			if d == nil {
+				continue
+			}
+			ws.aq <- &Aquire{f: &d.path, release: true, conn: d.conn}
+			delete(docs, d.conn.doc)
+			delete(paths, d.path)
+		case "list":
+			var lst weeded.ListMsg
+			err := msg.Decode(&lst)
+			if err != nil {
+				sendError(wconn, reqError(weeded.CodeBadRequest, err.Error()))
+				continue
+			}
+			dir, err := resolve(lst.Path)
+			if err == nil {
+				lst.Path = relPath(dir)
+				if dir != root && acl.Access(wconn.user, lst.Path) < ReadAccess {
+					err = reqError(weeded.CodePermission, "permission denied: "+lst.Path)
+				}
+			}
+			if err == nil {
+				lst.Entries, err = list(dir, wconn.user)
+			}
+			if err != nil {
+				sendError(wconn, err)
+				continue
+			}
+			send(wconn, "list", lst)
+		case "create", "rename", "delete":
+			var tree weeded.TreeMsg
+			err := msg.Decode(&tree)
+			if err != nil {
+				sendError(wconn, reqError(weeded.CodeBadRequest, err.Error()))
+				continue
+			}
+			tree.Op = msg.ID
+			ws.Change(wconn, tree)
 		case "open":
 			var f string
-			err := json.Unmarshal(*msg.Data, &f)
+			err := msg.Decode(&f)
 			if err != nil {
-				lg.Println(err)
-				return
+				sendError(wconn, reqError(weeded.CodeBadRequest, err.Error()))
+				continue
+			}
+			f, a, err := access(f)
+			if err != nil {
+				sendError(wconn, err)
+				continue
 			}
-			ret := make(chan (*Buffer))
-			aq <- &Aquire{f: &f, conn: wconn, ret: ret}
-			buf = <-ret
+			d, ok := docs[paths[f]]
+			if !ok {
+				nextDoc++
+				d = &openDoc{path: f, conn: wconn}
+				d.conn.doc = nextDoc
+			}
+			d.access = a
+			open(d, nil)
+		case "resume":
+			var res weeded.ResumeMsg
+			err := msg.Decode(&res)
+			if err != nil {
+				sendError(wconn, reqError(weeded.CodeBadRequest, err.Error()))
+				continue
+			}
+			f, a, err := access(res.Path)
+			if err == nil && len(res.Ops) > 0 && a < WriteAccess {
+				err = reqError(weeded.CodeReadOnly, "read-only file")
+			}
+			if err == nil && !rate.take(time.Now(), len(res.Ops)) {
+				err = &weeded.OpError{Ix: res.Ix, Err: limitError("op_rate", "too many ops, slow down")}
+			}
+			if err != nil {
+				sendError(wconn, err)
+				continue
+			}
+			if _, ok := paths[f]; ok {
+				sendError(wconn, reqError(weeded.CodeConflict, "already open: "+relPath(f)))
+				continue
+			}
+			// the document keeps the ID it had before if it is
+			// still free
+			doc := msg.Doc
+			if _, ok := docs[doc]; ok || doc == 0 {
+				nextDoc++
+				doc = nextDoc
+			} else if doc > nextDoc {
+				nextDoc = doc
+			}
+			d := &openDoc{path: f, conn: wconn, access: a}
+			d.conn.doc = doc
+			open(d, &res)
 		}
 	}
 }
+
+// userUID returns the uid of a user. It is derived from the name, so it is
+// stable across restarts. Bit 52 keeps it apart from connection ids, while
+// it still fits the integers of JavaScript clients.
+func userUID(user string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(user))
+	return h.Sum64()&(1<<52-1) | 1<<52
+}
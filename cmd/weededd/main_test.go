@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dane-unltd/weeded"
+)
+
+// identify sends "identify" for user on conn and returns the reply.
+func identify(t *testing.T, conn net.Conn, user string) weeded.Msg {
+	err := weeded.NewMsgWriter(conn).Send("identify", user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := weeded.NewMsgReader(conn).Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestIdentify(t *testing.T) {
+	defer testRoot(t)()
+	ws := NewWorkspace()
+	go ws.Run()
+	defer ws.Shutdown()
+
+	// connections over the network cannot claim an identity
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			handleClient(conn, 1, ws)
+		}
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	msg := identify(t, conn, "ann")
+	var em weeded.ErrorMsg
+	if msg.ID != "error" || msg.Decode(&em) != nil || em.Code != weeded.CodePermission {
+		t.Errorf("identified over tcp: %s %+v", msg.ID, em)
+	}
+
+	sock := filepath.Join(root, "test.sock")
+	uln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(sock)
+	defer uln.Close()
+	go func() {
+		conn, err := uln.Accept()
+		if err == nil {
+			handleClient(conn, 2, ws)
+		}
+	}()
+	uconn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uconn.Close()
+	msg = identify(t, uconn, "ann")
+	var uid uint64
+	if msg.ID != "identify" || msg.Decode(&uid) != nil || uid != userUID("ann") {
+		t.Errorf("not identified on a unix socket: %s %d", msg.ID, uid)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	defer testRoot(t, "a.txt")()
+	defer func(old func(string) (weeded.OpStore, error)) { openStore = old }(openStore)
+	var err error
+	openStore, err = storeOpener("mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := NewWorkspace()
+	go ws.Run()
+
+	conn, server := net.Pipe()
+	defer conn.Close()
+	done := make(chan struct{})
+	go func() {
+		handleClient(server, 1, ws)
+		close(done)
+	}()
+	r := weeded.NewMsgReader(conn)
+	err = weeded.NewMsgWriter(conn).Send("open", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		msg, err := r.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.ID == "buffer" {
+			break
+		}
+	}
+
+	// the messages queued are written before the connection is closed
+	ws.Shutdown()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var last weeded.MsgID
+	for {
+		msg, err := r.Receive()
+		if err != nil {
+			break
+		}
+		last = msg.ID
+	}
+	if last != "shutdown" {
+		t.Errorf("got %q before the connection was closed", last)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("client still handled after shutdown")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dane-unltd/weeded"
+)
+
+// sendQueueLen is the number of messages queued for a connection before it
+// is considered stuck and dropped.
+var sendQueueLen = 1024
+
+var errQueueFull = errors.New("send queue full, dropping connection")
+
+// flushTimeout is how long a connection has to take the messages queued for
+// it on shutdown before it is closed anyway.
+const flushTimeout = 5 * time.Second
+
+type outMsg struct {
+	id   weeded.MsgID
+	doc  uint64
+	data interface{}
+	// codec, if set, is switched to after the message has been written.
+	codec string
+}
+
+// sendQueue writes the messages for a connection in a goroutine of its own,
+// so a client which stops reading cannot block the buffers it shares with
+// other clients. A connection whose queue overflows is closed.
+type sendQueue struct {
+	msgs      chan outMsg
+	done      chan struct{}
+	once      sync.Once
+	flushing  chan struct{}
+	flushOnce sync.Once
+	conn      net.Conn
+}
+
+func newSendQueue(conn net.Conn) *sendQueue {
+	q := &sendQueue{
+		msgs:     make(chan outMsg, sendQueueLen),
+		done:     make(chan struct{}),
+		flushing: make(chan struct{}),
+		conn:     conn,
+	}
+	go q.run(weeded.NewMsgWriter(conn))
+	return q
+}
+
+func (q *sendQueue) run(w *weeded.MsgWriter) {
+	for {
+		select {
+		case m := <-q.msgs:
+			if !q.write(w, m) {
+				return
+			}
+		case <-q.flushing:
+			// write what has been queued so far, then close
+			for {
+				select {
+				case m := <-q.msgs:
+					if !q.write(w, m) {
+						return
+					}
+				default:
+					q.close()
+					return
+				}
+			}
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// write writes m to the connection and reports whether it succeeded. The
+// connection is closed if it did not.
+func (q *sendQueue) write(w *weeded.MsgWriter, m outMsg) bool {
+	err := w.SendDoc(m.id, m.doc, m.data)
+	if err == nil && m.codec != "" {
+		err = w.SetCodec(m.codec)
+	}
+	if err != nil {
+		lg.Println(err)
+		q.close()
+		return false
+	}
+	return true
+}
+
+// send queues m without blocking. Messages for a closed connection are
+// dropped silently.
+func (q *sendQueue) send(m outMsg) error {
+	select {
+	case <-q.done:
+		return nil
+	default:
+	}
+	select {
+	case q.msgs <- m:
+		return nil
+	default:
+		q.close()
+		return errQueueFull
+	}
+}
+
+// close closes the connection, which ends its handleClient as well.
+func (q *sendQueue) close() {
+	q.once.Do(func() {
+		close(q.done)
+		q.conn.Close()
+	})
+}
+
+// flush closes the connection once the messages queued for it have been
+// written, or after flushTimeout if the client does not take them.
+func (q *sendQueue) flush() {
+	q.flushOnce.Do(func() {
+		close(q.flushing)
+		time.AfterFunc(flushTimeout, q.close)
+	})
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dane-unltd/weeded"
+)
+
+// Workspace serves all files below root. Opening buffers and changes to the
+// tree are serialized by Run, so no file is moved while it is open.
+type Workspace struct {
+	aq       chan *Aquire
+	tree     chan treeReq
+	join     chan Conn
+	shutdown chan chan struct{}
+}
+
+type treeReq struct {
+	conn Conn
+	msg  weeded.TreeMsg
+}
+
+func NewWorkspace() *Workspace {
+	return &Workspace{
+		aq:       make(chan *Aquire),
+		tree:     make(chan treeReq),
+		join:     make(chan Conn),
+		shutdown: make(chan chan struct{}),
+	}
+}
+
+// Shutdown tells all connections the daemon is going down and closes all
+// buffers, writing them to disk. Each connection is closed once the
+// messages queued for it have been written. The workspace cannot be used
+// afterwards.
+func (ws *Workspace) Shutdown() {
+	ret := make(chan struct{})
+	ws.shutdown <- ret
+	<-ret
+}
+
+var errShutdown = reqError(weeded.CodeConflict, "shutting down")
+
+// storeSnapshots holds the suffix of the snapshot files of the stores which
+// keep their ops on disk.
+var storeSnapshots = map[string]string{
+	"msglog": ".snapshot" + weeded.StoreSuffix,
+	"flat":   ".flat" + weeded.StoreSuffix,
+}
+
+// recoverFiles opens and closes every file in the workspace kept by the
+// selected store, so ops lost to a crash before they were written to disk
+// are recovered from the log.
+func recoverFiles() error {
+	suffix, ok := storeSnapshots[storeName]
+	if !ok {
+		return nil
+	}
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(path, suffix) {
+			return err
+		}
+		name := strings.TrimSuffix(path, suffix)
+		store, err := openStore(name)
+		if err != nil {
+			lg.Println(err)
+			return nil
+		}
+		f, err := weeded.OpenFile(name, store)
+		if err != nil {
+			store.Close()
+			lg.Println(err)
+			return nil
+		}
+		f.Close()
+		return nil
+	})
+}
+
+// Join registers a connection for notifications about changes to the tree.
+// It is unregistered by the Aquire sent when it is closed.
+func (ws *Workspace) Join(conn Conn) {
+	ws.join <- conn
+}
+
+func (ws *Workspace) Change(conn Conn, msg weeded.TreeMsg) {
+	ws.tree <- treeReq{conn: conn, msg: msg}
+}
+
+// resolve maps a slash separated path relative to the workspace root to the
+// canonical path on disk, with all symbolic links resolved. Paths escaping
+// the root, directly or through a link, and the files kept by the op stores
+// are rejected.
+func resolve(p string) (string, error) {
+	path := filepath.Join(root, filepath.FromSlash(p))
+	if !within(path) {
+		return "", reqError(weeded.CodePermission, "path outside of workspace: "+p)
+	}
+	if isStoreFile(path) {
+		return "", reqError(weeded.CodePermission, "history files cannot be accessed: "+p)
+	}
+	path, err := evalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	if !within(path) {
+		return "", reqError(weeded.CodePermission, "path outside of workspace: "+p)
+	}
+	if isStoreFile(path) {
+		return "", reqError(weeded.CodePermission, "history files cannot be accessed: "+p)
+	}
+	return path, nil
+}
+
+// isStoreFile reports whether path names one of the files kept by the op
+// stores next to a file.
+func isStoreFile(path string) bool {
+	return path != root && strings.HasSuffix(path, weeded.StoreSuffix)
+}
+
+// within reports whether the clean path is the workspace root or below it.
+func within(path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// evalSymlinks resolves the links in the part of path which exists, so
+// files can still be created below it.
+func evalSymlinks(path string) (string, error) {
+	real, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		return real, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	if _, err := os.Lstat(path); err == nil {
+		return "", reqError(weeded.CodeNotFound, "dangling link: "+relPath(path))
+	}
+	dir := filepath.Dir(path)
+	if dir == path {
+		return path, nil
+	}
+	dir, err = evalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(path)), nil
+}
+
+// relPath returns the slash separated path of path relative to the workspace
+// root.
+func relPath(path string) string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
+
+// list returns all files and directories below dir user can read, leaving
+// out the files kept by the op stores.
+func list(dir, user string) ([]weeded.Entry, error) {
+	var entries []weeded.Entry
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir || strings.HasSuffix(info.Name(), weeded.StoreSuffix) {
+			return nil
+		}
+		e := weeded.Entry{Path: relPath(path), Dir: info.IsDir(), ModTime: info.ModTime()}
+		// directories are still walked, as rules for the files below
+		// them may grant more access
+		if acl.Access(user, e.Path) < ReadAccess {
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			// links are listed if their target can be opened
+			real, err := resolve(e.Path)
+			if err != nil || acl.Access(user, relPath(real)) < ReadAccess {
+				return nil
+			}
+		}
+		if !e.Dir {
+			e.Size = info.Size()
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	return entries, err
+}
+
+// isOpen reports whether a buffer is open for path or a file below it.
+func isOpen(buffers map[string]*Buffer, path string) bool {
+	for name := range buffers {
+		if name == path || strings.HasPrefix(name, path+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// writableTree checks user can write path and everything below it. If to is
+// not empty, the tree is going to be moved there and user needs to be able
+// to write the new paths as well. The files kept by the op stores follow
+// the files they belong to and are not checked.
+func writableTree(user, path, to string) error {
+	return filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if isStoreFile(p) {
+			return nil
+		}
+		rel := relPath(p)
+		if acl.Access(user, rel) < WriteAccess {
+			return reqError(weeded.CodePermission, "permission denied: "+rel)
+		}
+		if to == "" {
+			return nil
+		}
+		rel = relPath(to + strings.TrimPrefix(p, path))
+		if acl.Access(user, rel) < WriteAccess {
+			return reqError(weeded.CodePermission, "permission denied: "+rel)
+		}
+		return nil
+	})
+}
+
+// changeTree carries out a change to the tree requested by user, who needs
+// write access to all paths involved, including everything below a directory
+// which is renamed or deleted. On success msg is returned with its
+// paths cleaned.
+func changeTree(msg weeded.TreeMsg, user string, buffers map[string]*Buffer) (weeded.TreeMsg, error) {
+	path, err := resolve(msg.Path)
+	if err != nil {
+		return msg, err
+	}
+	if path == root {
+		return msg, reqError(weeded.CodePermission, "cannot change the workspace root")
+	}
+	msg.Path = relPath(path)
+	if acl.Access(user, msg.Path) < WriteAccess {
+		return msg, reqError(weeded.CodePermission, "permission denied: "+msg.Path)
+	}
+
+	switch msg.Op {
+	case "create":
+		if msg.Dir {
+			return msg, os.Mkdir(path, 0755)
+		}
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return msg, err
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return msg, err
+		}
+		return msg, f.Close()
+
+	case "rename":
+		to, err := resolve(msg.To)
+		if err != nil {
+			return msg, err
+		}
+		if to == root {
+			return msg, reqError(weeded.CodePermission, "cannot change the workspace root")
+		}
+		msg.To = relPath(to)
+		if acl.Access(user, msg.To) < WriteAccess {
+			return msg, reqError(weeded.CodePermission, "permission denied: "+msg.To)
+		}
+		if isOpen(buffers, path) || isOpen(buffers, to) {
+			return msg, reqError(weeded.CodeConflict, "file is open: "+msg.Path)
+		}
+		if _, err := os.Lstat(to); err == nil {
+			return msg, reqError(weeded.CodeExists, "file exists: "+msg.To)
+		}
+		err = writableTree(user, path, to)
+		if err != nil {
+			return msg, err
+		}
+		stores, err := weeded.StoreFiles(path)
+		if err != nil {
+			return msg, err
+		}
+		err = os.Rename(path, to)
+		if err != nil {
+			return msg, err
+		}
+		// the history moves along with the file
+		for _, name := range stores {
+			err = os.Rename(name, to+strings.TrimPrefix(name, path))
+			if err != nil {
+				lg.Println(err)
+			}
+		}
+		return msg, nil
+
+	case "delete":
+		if isOpen(buffers, path) {
+			return msg, reqError(weeded.CodeConflict, "file is open: "+msg.Path)
+		}
+		if _, err := os.Lstat(path); err != nil {
+			return msg, err
+		}
+		err = writableTree(user, path, "")
+		if err != nil {
+			return msg, err
+		}
+		stores, err := weeded.StoreFiles(path)
+		if err != nil {
+			return msg, err
+		}
+		err = os.RemoveAll(path)
+		if err != nil {
+			return msg, err
+		}
+		for _, name := range stores {
+			err = os.Remove(name)
+			if err != nil {
+				lg.Println(err)
+			}
+		}
+		return msg, nil
+	}
+	return msg, reqError(weeded.CodeBadRequest, "unknown tree change "+string(msg.Op))
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dane-unltd/weeded"
+)
+
+// testRoot makes a temporary directory the workspace root, with files
+// written relative to it. The returned function restores the old root.
+func testRoot(t *testing.T, files ...string) func() {
+	dir, err := ioutil.TempDir("", "weededd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := root
+	root = dir
+	for _, name := range files {
+		writeFile(t, name)
+	}
+	return func() {
+		root = old
+		os.RemoveAll(dir)
+	}
+}
+
+func writeFile(t *testing.T, name string) {
+	p := filepath.Join(root, filepath.FromSlash(name))
+	err := os.MkdirAll(filepath.Dir(p), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(p, []byte(name), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func exists(name string) bool {
+	_, err := os.Lstat(filepath.Join(root, filepath.FromSlash(name)))
+	return err == nil
+}
+
+func TestChangeTree(t *testing.T) {
+	defer testRoot(t, "a.txt", "a.txt.master.weeded", "dir/b.txt", "dir/c.txt")()
+	buffers := make(map[string]*Buffer)
+
+	tests := []struct {
+		msg  weeded.TreeMsg
+		code weeded.ErrorCode
+	}{
+		{weeded.TreeMsg{Op: "create", Path: "new/d.txt"}, ""},
+		{weeded.TreeMsg{Op: "create", Path: "new/d.txt"}, weeded.CodeExists},
+		{weeded.TreeMsg{Op: "create", Path: "empty", Dir: true}, ""},
+		{weeded.TreeMsg{Op: "create", Path: "."}, weeded.CodePermission},
+		{weeded.TreeMsg{Op: "rename", Path: "a.txt", To: "dir/c.txt"}, weeded.CodeExists},
+		{weeded.TreeMsg{Op: "rename", Path: "a.txt", To: "e.txt"}, ""},
+		{weeded.TreeMsg{Op: "rename", Path: "missing", To: "f.txt"}, weeded.CodeNotFound},
+		{weeded.TreeMsg{Op: "delete", Path: "dir/../new"}, ""},
+		{weeded.TreeMsg{Op: "delete", Path: "new"}, weeded.CodeNotFound},
+		{weeded.TreeMsg{Op: "delete", Path: ""}, weeded.CodePermission},
+		{weeded.TreeMsg{Op: "chmod", Path: "e.txt"}, weeded.CodeBadRequest},
+	}
+	for _, test := range tests {
+		_, err := changeTree(test.msg, "", buffers)
+		var code weeded.ErrorCode
+		if err != nil {
+			code = errorMsg(err).Code
+		}
+		if code != test.code {
+			t.Errorf("%s %s: got %v, want %q", test.msg.Op, test.msg.Path, err, test.code)
+		}
+	}
+
+	// the history moves along with the file
+	if exists("a.txt") || !exists("e.txt") || exists("a.txt.master.weeded") || !exists("e.txt.master.weeded") {
+		t.Error("file renamed without its history")
+	}
+	if exists("new") || !exists("empty") {
+		t.Error("tree not changed")
+	}
+
+	// paths are cleaned in the message broadcast to all clients
+	msg, err := changeTree(weeded.TreeMsg{Op: "rename", Path: "./dir/", To: "dir/../moved"}, "", buffers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Path != "dir" || msg.To != "moved" || !exists("moved/b.txt") {
+		t.Errorf("renamed %q to %q", msg.Path, msg.To)
+	}
+
+	// open files and the directories containing them stay put
+	buffers[filepath.Join(root, "moved", "b.txt")] = nil
+	for _, msg := range []weeded.TreeMsg{
+		{Op: "delete", Path: "moved"},
+		{Op: "rename", Path: "moved/b.txt", To: "b.txt"},
+		{Op: "rename", Path: "e.txt", To: "moved/b.txt"},
+	} {
+		_, err = changeTree(msg, "", buffers)
+		if err == nil || errorMsg(err).Code != weeded.CodeConflict {
+			t.Errorf("%s %s while open: %v", msg.Op, msg.Path, err)
+		}
+	}
+	if !exists("moved/b.txt") {
+		t.Error("open file changed")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	defer testRoot(t, "a.txt", "a.txt.snapshot.weeded", "dir/b.txt")()
+	outside, err := ioutil.TempDir("", "weededd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	for link, target := range map[string]string{
+		"in":       "dir",
+		"out":      outside,
+		"dir/up":   "../..",
+		"dir/self": "..",
+		"hist":     "a.txt.snapshot.weeded",
+		"dangling": "missing",
+	} {
+		err = os.Symlink(target, filepath.Join(root, filepath.FromSlash(link)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path string
+		want string
+		code weeded.ErrorCode
+	}{
+		{"a.txt", "a.txt", ""},
+		{"/dir/./b.txt", "dir/b.txt", ""},
+		{"dir/new/c.txt", "dir/new/c.txt", ""},
+		{"in/b.txt", "dir/b.txt", ""},
+		{"dir/self/a.txt", "a.txt", ""},
+		{"", ".", ""},
+		{"..", "", weeded.CodePermission},
+		{"dir/../../a.txt", "", weeded.CodePermission},
+		{"out", "", weeded.CodePermission},
+		{"out/new.txt", "", weeded.CodePermission},
+		{"dir/up/a.txt", "", weeded.CodePermission},
+		{"a.txt.snapshot.weeded", "", weeded.CodePermission},
+		{"dir/../a.txt.master.0.weeded", "", weeded.CodePermission},
+		{"hist", "", weeded.CodePermission},
+		{"dangling", "", weeded.CodeNotFound},
+	}
+	for _, test := range tests {
+		path, err := resolve(test.path)
+		if err != nil {
+			if code := errorMsg(err).Code; code != test.code {
+				t.Errorf("%q: got %v, want %q", test.path, err, test.code)
+			}
+			continue
+		}
+		if test.code != "" || relPath(path) != test.want {
+			t.Errorf("%q resolved to %q", test.path, path)
+		}
+	}
+}
+
+func TestChangeTreeACL(t *testing.T) {
+	defer testRoot(t, "docs/a.txt", "docs/locked/b.txt", "pub/c.txt")()
+	defer func(old *ACL) { acl = old }(acl)
+	acl = &ACL{
+		Default: WriteAccess,
+		Rules: []Rule{
+			{Path: "docs/locked", Users: []string{"*"}, Access: ReadAccess},
+			{Path: "archive/locked", Users: []string{"*"}, Access: ReadAccess},
+		},
+	}
+	buffers := make(map[string]*Buffer)
+
+	// a directory can only be changed if everything below it can
+	for _, msg := range []weeded.TreeMsg{
+		{Op: "delete", Path: "docs"},
+		{Op: "rename", Path: "docs", To: "archive"},
+		{Op: "rename", Path: "pub", To: "docs/locked/pub"},
+		{Op: "create", Path: "docs/locked/d.txt"},
+	} {
+		_, err := changeTree(msg, "ann", buffers)
+		if err == nil || errorMsg(err).Code != weeded.CodePermission {
+			t.Errorf("%s %s: %v", msg.Op, msg.Path, err)
+		}
+	}
+	if !exists("docs/a.txt") || !exists("docs/locked/b.txt") || !exists("pub/c.txt") {
+		t.Fatal("tree changed without access")
+	}
+
+	// rules deeper down only matter where the tree ends up
+	_, err := changeTree(weeded.TreeMsg{Op: "rename", Path: "pub", To: "docs/pub"}, "ann", buffers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = changeTree(weeded.TreeMsg{Op: "delete", Path: "docs/a.txt"}, "ann", buffers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists("docs/pub/c.txt") || exists("docs/a.txt") {
+		t.Error("tree not changed")
+	}
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
-	"encoding/json"
+	"flag"
+	"fmt"
 	"log"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/dane-unltd/weeded"
 	"github.com/dane-unltd/weeded/wss"
 )
 
@@ -22,8 +26,32 @@ var weedAddr = "/tmp/weeded.sock"
 var weedNetw = "unix"
 
 func main() {
-	if len(os.Args) >= 2 {
-		strs := strings.SplitN(os.Args[2], ":", 2)
+	keys := flag.String("keys", "", "file with the token keys, created if missing")
+	issue := flag.String("issue", "", "print a token for this user and exit")
+	ttl := flag.Duration("ttl", 24*time.Hour, "validity of issued tokens")
+	anon := flag.Bool("anonymous", false, "accept websockets without a token")
+	flag.Parse()
+
+	if *keys != "" {
+		err := loadKeys(*keys)
+		if err != nil {
+			lg.Fatalln(err)
+		}
+	}
+	if *issue != "" {
+		if *keys == "" {
+			lg.Fatalln("tokens issued without -keys are only valid for this process")
+		}
+		tok, err := issueToken(*issue, *ttl)
+		if err != nil {
+			lg.Fatalln(err)
+		}
+		fmt.Println(string(tok))
+		return
+	}
+
+	if flag.NArg() >= 1 {
+		strs := strings.SplitN(flag.Arg(0), ":", 2)
 		if len(strs) == 1 {
 			weedAddr = strs[0]
 		} else {
@@ -38,7 +66,14 @@ func main() {
 	}
 
 	serv := wss.New()
-	ln := serv.Listen("tcp", "11000", "file")
+	if !*anon {
+		if weedNetw != "unix" {
+			// weededd only accepts "identify" on unix sockets
+			lg.Fatalln("users can only be identified to weededd on a unix socket")
+		}
+		serv.Auth = authenticate
+	}
+	ln := serv.Listen("tcp", ":11000", "/file")
 
 	for {
 		wsc := ln.Accept()
@@ -48,40 +83,149 @@ func main() {
 			continue
 		}
 
-		go func(wsc *wss.Connection, conn net.Conn) {
-			enc := json.NewEncoder(conn)
+		bc := &browserConn{wsc: wsc}
+		w := weeded.NewMsgWriter(conn)
+		if wsc.User() != "" {
+			// weededd trusts the identity sent on its unix socket
+			err = w.Send("identify", wsc.User())
+			if err != nil {
+				lg.Println(err)
+				conn.Close()
+				continue
+			}
+		}
+
+		// once either side is gone both are closed, which ends the
+		// other goroutine as well and lets weededd release the
+		// connection
+		go func(bc *browserConn, conn net.Conn) {
+			defer bc.wsc.Close()
+			defer conn.Close()
 			for {
-				msg, err := wsc.Receive()
+				msg, err := bc.Receive()
 				if err != nil {
 					lg.Println(err)
 					return
 				}
 				switch msg.ID {
+				case "codec":
+					var codec string
+					err := msg.Decode(&codec)
+					if err != nil {
+						lg.Println(err)
+						return
+					}
+					err = bc.SetCodec(codec)
+					if err != nil {
+						lg.Println(err)
+						return
+					}
 				case "ot":
-					err := enc.Encode(msg)
+					var otmsg weeded.OtMsg
+					err := msg.Decode(&otmsg)
+					if err != nil {
+						lg.Println(err)
+						return
+					}
+					err = w.SendDoc(msg.ID, msg.Doc, otmsg)
+					if err != nil {
+						lg.Println(err)
+						return
+					}
+				case "identify":
+					// the identity is taken from the token only
+				default:
+					err := w.SendDoc(msg.ID, msg.Doc, msg.Data)
 					if err != nil {
 						lg.Println(err)
 						return
 					}
 				}
 			}
-		}(wsc, conn)
+		}(bc, conn)
 
-		go func(wsc *wss.Connection, conn net.Conn) {
-			dec := json.NewDecoder(conn)
+		go func(bc *browserConn, conn net.Conn) {
+			defer bc.wsc.Close()
+			defer conn.Close()
+			r := weeded.NewMsgReader(conn)
 			for {
-				var msg wss.Message
-				err := dec.Decode(&msg)
+				msg, err := r.Receive()
 				if err != nil {
 					lg.Println(err)
 					return
 				}
-				err = wsc.Send(msg.ID, msg.Data)
+				var data interface{} = msg.Data
+				if msg.ID == "ot" {
+					// decoded so it can be sent in the binary codec
+					var otmsg weeded.OtMsg
+					err := msg.Decode(&otmsg)
+					if err != nil {
+						lg.Println(err)
+						return
+					}
+					data = otmsg
+				}
+				err = bc.Send(msg.ID, msg.Doc, data)
 				if err != nil {
 					lg.Println(err)
 					return
 				}
 			}
-		}(wsc, conn)
+		}(bc, conn)
+	}
+}
+
+// browserConn sends and receives messages on a websocket in the codec the
+// browser asked for with a "codec" message.
+type browserConn struct {
+	wsc *wss.Connection
+
+	mu     sync.Mutex
+	binary bool
+}
+
+func (bc *browserConn) Receive() (weeded.Msg, error) {
+	msg, err := bc.wsc.Receive()
+	if err != nil {
+		return weeded.Msg{}, err
+	}
+	if msg.Frame != nil {
+		return weeded.ParseFrame(msg.Frame)
+	}
+	return weeded.Msg{ID: weeded.MsgID(msg.ID), Doc: msg.Doc, Data: msg.Data}, nil
+}
+
+func (bc *browserConn) Send(id weeded.MsgID, doc uint64, data interface{}) error {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if !bc.binary {
+		return bc.wsc.SendDoc(wss.MsgID(id), doc, data)
+	}
+	frame, err := weeded.AppendFrame(nil, id, doc, data)
+	if err != nil {
+		return err
+	}
+	return bc.wsc.SendFrame(frame)
+}
+
+// SetCodec replies to a "codec" message and switches to the codec for all
+// following messages. Unknown codecs are answered with weeded.CodecJSON.
+func (bc *browserConn) SetCodec(codec string) error {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if codec != weeded.CodecBinary {
+		codec = weeded.CodecJSON
+	}
+	var err error
+	if bc.binary {
+		var frame []byte
+		frame, err = weeded.AppendFrame(nil, "codec", 0, codec)
+		if err == nil {
+			err = bc.wsc.SendFrame(frame)
+		}
+	} else {
+		err = bc.wsc.Send("codec", codec)
 	}
+	bc.binary = codec == weeded.CodecBinary
+	return err
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Session is carried by the token a browser presents when opening the
+// websocket.
+type Session struct {
+	User    string
+	Expires time.Time
+}
+
+// issueToken returns a token for user which is valid for ttl.
+func issueToken(user string, ttl time.Duration) ([]byte, error) {
+	if user == "" {
+		return nil, errors.New("token: empty user name")
+	}
+	return generateToken(Session{User: user, Expires: time.Now().Add(ttl)})
+}
+
+// authenticate validates the token of a websocket upgrade request and
+// returns its user. The token is taken from the "token" query parameter, the
+// "token" cookie or a bearer Authorization header.
+func authenticate(r *http.Request) (string, error) {
+	tok := r.URL.Query().Get("token")
+	if tok == "" {
+		if c, err := r.Cookie("token"); err == nil {
+			tok = c.Value
+		}
+	}
+	if tok == "" {
+		tok = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if tok == "" {
+		return "", errors.New("token: missing")
+	}
+
+	var s Session
+	err := validateToken([]byte(tok), &s)
+	if err != nil {
+		return "", err
+	}
+	if s.User == "" || time.Now().After(s.Expires) {
+		return "", errors.New("token: expired")
+	}
+	return s.User, nil
+}
@@ -14,6 +14,8 @@ import (
 	"errors"
 	"hash"
 	"io"
+	"io/ioutil"
+	"os"
 )
 
 var hashKey []byte
@@ -38,6 +40,45 @@ func init() {
 	}
 }
 
+// tokenKeys holds the keys tokens are signed and encrypted with.
+type tokenKeys struct {
+	Hash  []byte
+	Block []byte
+}
+
+// loadKeys replaces the random keys of the process with the keys in
+// filename, so tokens stay valid across restarts. A missing file is created
+// with new random keys.
+func loadKeys(filename string) error {
+	var keys tokenKeys
+	buf, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		keys = tokenKeys{Hash: GenerateRandomKey(64), Block: GenerateRandomKey(32)}
+		if keys.Hash == nil || keys.Block == nil {
+			return errors.New("token: failed to generate keys")
+		}
+		buf, err = json.Marshal(keys)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(filename, buf, 0600)
+	} else if err == nil {
+		err = json.Unmarshal(buf, &keys)
+	}
+	if err != nil {
+		return err
+	}
+	if len(keys.Hash) < 32 {
+		return errors.New("token: hash key too short")
+	}
+	b, err := aes.NewCipher(keys.Block)
+	if err != nil {
+		return err
+	}
+	hashKey, block = keys.Hash, b
+	return nil
+}
+
 func generateToken(v interface{}) ([]byte, error) {
 	var b []byte
 	var err error
@@ -0,0 +1,313 @@
+package weeded
+
+import (
+	"bufio"
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+)
+
+// otMsgVersion is the version of the binary encoding of an OtMsg, stored as
+// its first byte. It can never be '{', so logs written as JSON before the
+// binary encoding existed can still be read. Version 1 lacks Seq.
+const otMsgVersion = 2
+
+// MarshalBinary encodes otmsg as a version byte, Ix, UID and Seq as uvarints
+// and the binary encoding of Op.
+func (otmsg OtMsg) MarshalBinary() ([]byte, error) {
+	if otmsg.Ix < 0 {
+		return nil, errors.New("negative revision")
+	}
+	buf := []byte{otMsgVersion}
+	buf = binary.AppendUvarint(buf, uint64(otmsg.Ix))
+	buf = binary.AppendUvarint(buf, otmsg.UID)
+	buf = binary.AppendUvarint(buf, otmsg.Seq)
+	return otmsg.Op.AppendBinary(buf)
+}
+
+func (otmsg *OtMsg) UnmarshalBinary(buf []byte) error {
+	if len(buf) == 0 || buf[0] < 1 || buf[0] > otMsgVersion {
+		return errors.New("unknown op message encoding")
+	}
+	i := 1
+	ix, n := binary.Uvarint(buf[i:])
+	if n <= 0 || int64(ix) < 0 {
+		return errors.New("invalid revision")
+	}
+	i += n
+	uid, n := binary.Uvarint(buf[i:])
+	if n <= 0 {
+		return errors.New("invalid user")
+	}
+	i += n
+	var seq uint64
+	if buf[0] >= 2 {
+		seq, n = binary.Uvarint(buf[i:])
+		if n <= 0 {
+			return errors.New("invalid sequence number")
+		}
+		i += n
+	}
+	otmsg.Ix = int64(ix)
+	otmsg.UID = uid
+	otmsg.Seq = seq
+	return otmsg.Op.UnmarshalBinary(buf[i:])
+}
+
+// decodeOtMsg decodes an op stored in a log, either in the binary encoding
+// or as JSON.
+func decodeOtMsg(buf []byte) (OtMsg, error) {
+	var otmsg OtMsg
+	if len(buf) > 0 && buf[0] == '{' {
+		err := json.Unmarshal(buf, &otmsg)
+		return otmsg, err
+	}
+	err := otmsg.UnmarshalBinary(buf)
+	return otmsg, err
+}
+
+// Codecs messages can be sent with. Every connection starts out with
+// CodecJSON, where every message is followed by a newline as written by
+// json.Encoder. A client can ask for another codec by sending a "codec"
+// message with its name before opening a file. The daemon replies with a
+// "codec" message holding the codec it picked, and both sides switch to it
+// for every message after that. CodecJSON stays available for debugging.
+const (
+	CodecJSON   = "json"
+	CodecBinary = "binary"
+)
+
+// Payload encodings of a binary frame.
+const (
+	payloadJSON = iota
+	payloadBinary
+)
+
+// AppendFrame appends a message in the binary codec to buf. A frame is a
+// uvarint length followed by the length prefixed ID, the document as
+// uvarint, a byte telling the encoding of the payload and the payload. Data
+// implementing encoding.BinaryMarshaler is sent in its binary encoding,
+// everything else as JSON.
+func AppendFrame(buf []byte, id MsgID, doc uint64, data interface{}) ([]byte, error) {
+	var pl []byte
+	var err error
+	kind := byte(payloadJSON)
+	if m, ok := data.(encoding.BinaryMarshaler); ok {
+		kind = payloadBinary
+		pl, err = m.MarshalBinary()
+	} else {
+		pl, err = json.Marshal(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	n := uvarintLen(uint64(len(id))) + len(id) + uvarintLen(doc) + 1 + len(pl)
+	buf = binary.AppendUvarint(buf, uint64(n))
+	buf = binary.AppendUvarint(buf, uint64(len(id)))
+	buf = append(buf, id...)
+	buf = binary.AppendUvarint(buf, doc)
+	buf = append(buf, kind)
+	return append(buf, pl...), nil
+}
+
+// ParseFrame decodes a frame as written by AppendFrame.
+func ParseFrame(buf []byte) (Msg, error) {
+	n, l := binary.Uvarint(buf)
+	if l <= 0 || n != uint64(len(buf)-l) {
+		return Msg{}, errors.New("invalid message frame")
+	}
+	return parseFrame(buf[l:])
+}
+
+// parseFrame decodes a frame without its leading length.
+func parseFrame(buf []byte) (Msg, error) {
+	var msg Msg
+	n, l := binary.Uvarint(buf)
+	if l <= 0 || n >= uint64(len(buf)-l) {
+		return msg, errors.New("invalid message frame")
+	}
+	msg.ID = MsgID(buf[l : l+int(n)])
+	buf = buf[l+int(n):]
+	msg.Doc, l = binary.Uvarint(buf)
+	if l <= 0 || l >= len(buf) {
+		return msg, errors.New("invalid message frame")
+	}
+	pl := json.RawMessage(buf[l+1:])
+	msg.Data = &pl
+	switch buf[l] {
+	case payloadJSON:
+	case payloadBinary:
+		msg.bin = true
+	default:
+		return msg, errors.New("unknown payload encoding")
+	}
+	return msg, nil
+}
+
+func uvarintLen(v uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], v)
+}
+
+// Decode decodes the payload of msg into v.
+func (msg *Msg) Decode(v interface{}) error {
+	if msg.Data == nil {
+		return errors.New("message without data")
+	}
+	if msg.bin {
+		u, ok := v.(encoding.BinaryUnmarshaler)
+		if !ok {
+			return errors.New("binary payload for " + string(msg.ID))
+		}
+		return u.UnmarshalBinary(*msg.Data)
+	}
+	return json.Unmarshal(*msg.Data, v)
+}
+
+// MsgWriter sends messages on a connection. It is safe for concurrent use.
+type MsgWriter struct {
+	mu    sync.Mutex
+	w     io.Writer
+	enc   *json.Encoder
+	codec string
+	buf   []byte
+}
+
+func NewMsgWriter(w io.Writer) *MsgWriter {
+	return &MsgWriter{w: w, enc: json.NewEncoder(w), codec: CodecJSON}
+}
+
+func (mw *MsgWriter) Send(id MsgID, data interface{}) error {
+	return mw.SendDoc(id, 0, data)
+}
+
+// SendDoc sends a message referring to the document doc.
+func (mw *MsgWriter) SendDoc(id MsgID, doc uint64, data interface{}) error {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	if mw.codec == CodecJSON {
+		return mw.enc.Encode(struct {
+			ID   MsgID
+			Doc  uint64 `json:",omitempty"`
+			Data interface{}
+		}{id, doc, data})
+	}
+	buf, err := AppendFrame(mw.buf[:0], id, doc, data)
+	if err != nil {
+		return err
+	}
+	mw.buf = buf
+	_, err = mw.w.Write(buf)
+	return err
+}
+
+// SetCodec switches the codec for all following messages.
+func (mw *MsgWriter) SetCodec(codec string) error {
+	if codec != CodecJSON && codec != CodecBinary {
+		return errors.New("unknown codec " + codec)
+	}
+	mw.mu.Lock()
+	mw.codec = codec
+	mw.mu.Unlock()
+	return nil
+}
+
+// maxMsgSize is the size of the largest message a MsgReader accepts, in
+// either codec.
+var maxMsgSize int64 = 64 << 20
+
+var errMsgTooLarge = errors.New("message too large")
+
+// msgLimit fails reads once n bytes have been read, so a JSON message
+// without an end cannot take up all memory.
+type msgLimit struct {
+	r io.Reader
+	n int64
+}
+
+func (l *msgLimit) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, errMsgTooLarge
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// MsgReader receives messages from a connection.
+type MsgReader struct {
+	r   io.Reader
+	lim *msgLimit
+	dec *json.Decoder
+	br  *bufio.Reader
+	// nl is set until the newline ending the last JSON message has been
+	// read after switching to CodecBinary.
+	nl bool
+}
+
+func NewMsgReader(r io.Reader) *MsgReader {
+	lim := &msgLimit{r: r}
+	return &MsgReader{r: r, lim: lim, dec: json.NewDecoder(lim)}
+}
+
+func (mr *MsgReader) Receive() (Msg, error) {
+	var msg Msg
+	if mr.br == nil {
+		// the part of the message read ahead with the one before is
+		// not counted, which at most doubles the limit
+		mr.lim.n = maxMsgSize
+		err := mr.dec.Decode(&msg)
+		return msg, err
+	}
+	if mr.nl {
+		b, err := mr.br.ReadByte()
+		if err != nil {
+			return msg, err
+		}
+		if b != '\n' {
+			return msg, errors.New("missing newline before binary messages")
+		}
+		mr.nl = false
+	}
+	n, err := binary.ReadUvarint(mr.br)
+	if err != nil {
+		return msg, err
+	}
+	if n > uint64(maxMsgSize) {
+		return msg, errMsgTooLarge
+	}
+	buf := make([]byte, n)
+	_, err = io.ReadFull(mr.br, buf)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return msg, err
+	}
+	return parseFrame(buf)
+}
+
+// SetCodec switches the codec for all following messages. Once switched to
+// CodecBinary it cannot be switched back.
+func (mr *MsgReader) SetCodec(codec string) error {
+	switch codec {
+	case CodecJSON:
+		if mr.br != nil {
+			return errors.New("cannot switch back to " + codec)
+		}
+	case CodecBinary:
+		if mr.br == nil {
+			mr.br = bufio.NewReader(io.MultiReader(mr.dec.Buffered(), mr.r))
+			mr.nl = true
+		}
+	default:
+		return errors.New("unknown codec " + codec)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package weeded
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/dane-unltd/weeded/ot"
+)
+
+func TestCodec(t *testing.T) {
+	otmsg := OtMsg{Ix: 300, UID: 7, Seq: 12, Op: ot.Op{}.Retain(2).Delete("xyz").Insert("a")}
+
+	var conn bytes.Buffer
+	w := NewMsgWriter(&conn)
+	r := NewMsgReader(&conn)
+
+	// the first message is JSON, everything after it binary
+	err := w.Send("codec", CodecBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetCodec(CodecBinary)
+	for _, data := range []interface{}{otmsg, "file.txt"} {
+		err = w.SendDoc("ot", 3, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msg, err := r.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var codec string
+	if err = msg.Decode(&codec); err != nil || msg.ID != "codec" || codec != CodecBinary {
+		t.Fatal("unexpected codec message", msg.ID, codec, err)
+	}
+	r.SetCodec(codec)
+
+	msg, err = r.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got OtMsg
+	if err = msg.Decode(&got); err != nil || msg.ID != "ot" || msg.Doc != 3 {
+		t.Fatal("unexpected op message", msg.ID, err)
+	}
+	if got.Ix != otmsg.Ix || got.UID != otmsg.UID || got.Seq != otmsg.Seq || !got.Op.Equals(otmsg.Op) {
+		t.Error("got", got)
+	}
+
+	msg, err = r.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var name string
+	if err = msg.Decode(&name); err != nil || name != "file.txt" {
+		t.Error("unexpected JSON payload", name, err)
+	}
+
+	// logs written before the binary encoding hold JSON
+	got, err = decodeOtMsg([]byte(`{"Ix":3,"UID":1,"Op":[{"N":1,"S":"a"}]}`))
+	if err != nil || got.Ix != 3 || !got.Op.Equals(ot.Op{}.Insert("a")) {
+		t.Error("unexpected JSON op", got, err)
+	}
+
+	// version 1 has no sequence number
+	v1, err := ot.Op{}.Insert("a").AppendBinary([]byte{1, 3, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = decodeOtMsg(v1)
+	if err != nil || got.Ix != 3 || got.UID != 1 || got.Seq != 0 || !got.Op.Equals(ot.Op{}.Insert("a")) {
+		t.Error("unexpected version 1 op", got, err)
+	}
+}
+
+func TestMsgSize(t *testing.T) {
+	defer func(n int64) { maxMsgSize = n }(maxMsgSize)
+	maxMsgSize = 1 << 10
+
+	var conn bytes.Buffer
+	w := NewMsgWriter(&conn)
+	r := NewMsgReader(&conn)
+	small := strings.Repeat("a", 500)
+	for i := 0; i < 4; i++ {
+		err := w.Send("ot", small)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := r.Receive(); err != nil {
+			t.Fatal("message within the limit:", err)
+		}
+	}
+
+	// a JSON message which does not end is not read into memory
+	r = NewMsgReader(io.MultiReader(strings.NewReader(`{"ID":"ot","Data":"`), endless{}))
+	if _, err := r.Receive(); err != errMsgTooLarge {
+		t.Error("unbounded JSON message:", err)
+	}
+
+	conn.Reset()
+	w = NewMsgWriter(&conn)
+	r = NewMsgReader(&conn)
+	err := w.Send("codec", CodecBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetCodec(CodecBinary)
+	err = w.Send("ot", strings.Repeat("a", 2000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Receive(); err != nil {
+		t.Fatal(err)
+	}
+	r.SetCodec(CodecBinary)
+	if _, err := r.Receive(); err != errMsgTooLarge {
+		t.Error("binary message beyond the limit:", err)
+	}
+}
+
+// endless reads as an infinite string of a's.
+type endless struct{}
+
+func (endless) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'a'
+	}
+	return len(p), nil
+}
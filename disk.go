@@ -0,0 +1,130 @@
+package weeded
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/dane-unltd/weeded/ot"
+)
+
+// DiskUID is the author of ops merging modifications made to a file on disk
+// by other programs.
+const DiskUID uint64 = 0
+
+// ErrModifiedOnDisk is returned by Save if the file has been modified on disk
+// since it was last read or written. Reload merges the modification.
+var ErrModifiedOnDisk = errors.New("file modified on disk")
+
+// reload merges modifications of the file on disk which happened since it
+// was last read or written. The modification is based on the revision
+// which was last synced with the disk, so concurrent edits of the users are
+// kept. ok reports whether an op was applied. If that revision has been
+// compacted, the modification is not merged and ErrModifiedOnDisk is
+// returned.
+func (f *File) reload() (otmsg OtMsg, ok bool, err error) {
+	fi, err := os.Stat(f.filename)
+	if os.IsNotExist(err) {
+		return otmsg, false, nil
+	}
+	if err != nil {
+		return otmsg, false, err
+	}
+	if f.diskIx >= 0 && fi.ModTime().Equal(f.diskMod) && fi.Size() == f.diskSize {
+		return otmsg, false, nil
+	}
+	content, err := ioutil.ReadFile(f.filename)
+	if err != nil {
+		return otmsg, false, err
+	}
+
+	ix := f.diskIx
+	var base []byte
+	if ix >= 0 {
+		base, err = f.contentAt(ix)
+		if err != nil {
+			// the modification cannot be merged without its base, and
+			// diffing against the buffer would revert the edits since
+			return otmsg, false, fmt.Errorf("%w, cannot merge: revision %d: %v", ErrModifiedOnDisk, ix, err)
+		}
+	} else {
+		ix = f.nextIx
+		base = f.buf
+	}
+	if bytes.Equal(base, content) {
+		return otmsg, false, f.synced(ix, fi)
+	}
+
+	otmsg, err = f.apply(OtMsg{Ix: ix, UID: DiskUID, Op: ot.Diff(base, content)})
+	if err != nil {
+		return otmsg, false, err
+	}
+	if bytes.Equal(f.buf, content) {
+		err = f.synced(f.nextIx, fi)
+	} else {
+		err = f.writeFile()
+	}
+	return otmsg, true, err
+}
+
+// writeFile atomically replaces the file on disk with the buffer and
+// remembers the revision written. The mode of an existing file is kept.
+func (f *File) writeFile() error {
+	perm := os.FileMode(0644)
+	if fi, err := os.Stat(f.filename); err == nil {
+		perm = fi.Mode().Perm()
+	}
+	err := writeFileAtomic(f.filename, f.buf, perm)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(f.filename)
+	if err != nil {
+		return err
+	}
+	return f.synced(f.nextIx, fi)
+}
+
+// synced records that the file on disk, as described by fi, holds revision
+// ix. A snapshot is written, so after a crash the ops which did not make it
+// to disk are known.
+func (f *File) synced(ix int64, fi os.FileInfo) error {
+	if ix == f.diskIx && fi.ModTime().Equal(f.diskMod) && fi.Size() == f.diskSize {
+		return nil
+	}
+	f.diskIx = ix
+	f.diskMod = fi.ModTime()
+	f.diskSize = fi.Size()
+	return f.snapshot()
+}
+
+// save writes the buffer to disk unless the disk is up to date. It returns
+// the revision on disk.
+func (f *File) save() (int64, error) {
+	if f.diskIx == f.nextIx {
+		return f.diskIx, nil
+	}
+	if f.diskIx >= 0 {
+		fi, err := os.Stat(f.filename)
+		if err == nil && (!fi.ModTime().Equal(f.diskMod) || fi.Size() != f.diskSize) {
+			return f.diskIx, ErrModifiedOnDisk
+		}
+	}
+	err := f.writeFile()
+	return f.diskIx, err
+}
+
+// recover writes ops which are in the log but did not make it to disk
+// before the file was last closed, for example because of a crash.
+func (f *File) recover() error {
+	if f.diskIx < 0 || f.diskIx == f.nextIx {
+		return nil
+	}
+	if _, err := os.Stat(f.filename); os.IsNotExist(err) {
+		// deleted on disk while not open
+		return nil
+	}
+	return f.writeFile()
+}
@@ -1,138 +1,240 @@
 package weeded
 
 import (
-	"encoding/json"
-	"io/ioutil"
+	"errors"
+	"fmt"
 	"log"
+	"time"
 
-	"github.com/dane-unltd/msglog"
 	"github.com/dane-unltd/weeded/ot"
 )
 
-type OtMsg struct {
-	Ix int64
-	Op ot.Operation
+type otReq struct {
+	msg OtMsg
+	ret chan otRes
+}
+
+type otRes struct {
+	msg OtMsg
+	dup bool
+	err error
+}
+
+type histReq struct {
+	from, to int64
+	ret      chan histRes
+}
+
+type histRes struct {
+	msgs []OtMsg
+	err  error
+}
+
+type atReq struct {
+	ix  int64
+	ret chan atRes
+}
+
+type atRes struct {
+	buf []byte
+	err error
+}
+
+type blameRes struct {
+	lines []BlameLine
+	err   error
+}
+
+type reloadRes struct {
+	msg OtMsg
+	ok  bool
+	err error
+}
+
+type saveRes struct {
+	ix  int64
+	err error
+}
+
+type resumeReq struct {
+	uid  uint64
+	ix   int64
+	ops  []ot.Op
+	seqs []uint64
+	ret  chan resumeRes
+}
+
+type resumeRes struct {
+	remote  []ot.Op
+	applied []OtMsg
+	err     error
+}
+
+type compactReq struct {
+	keep int64
+	ret  chan error
+}
+
+// OpError is returned for an op which has been rejected, as it does not
+// apply to the revision Ix it was based on. The file is left unchanged.
+type OpError struct {
+	Ix  int64
+	Err error
+}
+
+func (e *OpError) Error() string {
+	return fmt.Sprintf("op at revision %d: %v", e.Ix, e.Err)
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
 }
 
 type File struct {
 	filename string
 
-	otLog    *msglog.Log
-	consumer *msglog.Consumer
-	buf      []byte
-	ots      chan OtMsg
-	full     chan chan []byte
-	quit     chan chan struct{}
-	nextIx   int64
+	store   OpStore
+	buf     []byte
+	ots     chan otReq
+	full    chan chan BufferMsg
+	hist    chan histReq
+	at      chan atReq
+	blame   chan chan blameRes
+	reloads chan chan reloadRes
+	saves   chan chan saveRes
+	resumes chan resumeReq
+	limits  chan ot.Limits
+	compact chan compactReq
+	quit    chan chan struct{}
+	nextIx  int64
+	snapIx  int64
+	// seqs holds the sequence numbers of the latest ops of every user.
+	seqs ot.SeqTable
+	// lim bounds the ops applied, see SetLimits.
+	lim ot.Limits
+
+	// diskIx is the revision last read from or written to disk, -1 if
+	// unknown. diskMod and diskSize describe the file at that point.
+	diskIx   int64
+	diskMod  time.Time
+	diskSize int64
 }
 
+// NewFile opens filename with its ops kept in a MsglogStore.
 func NewFile(filename string) (*File, error) {
-	l, err := msglog.Recover(filename + ".master.weeded")
+	store, err := NewMsglogStore(filename)
 	if err != nil {
 		return nil, err
 	}
-	f := &File{
-		otLog: l,
+	f, err := OpenFile(filename, store)
+	if err != nil {
+		store.Close()
+		return nil, err
 	}
+	return f, nil
+}
 
-	c, err := l.Consumer()
+// OpenFile opens filename with its ops kept in store. The store is closed
+// together with the file.
+func OpenFile(filename string, store OpStore) (*File, error) {
+	snap, err := store.Snapshot()
 	if err != nil {
 		return nil, err
 	}
+	f := &File{
+		store:  store,
+		buf:    snap.Content,
+		nextIx: snap.Ix,
+		snapIx: snap.Ix,
+		seqs:   snap.Seqs,
 
-	var op ot.Operation
-	for c.HasNext() {
-		_, err := c.Next()
-		if err != nil {
-			return nil, err
-		}
-		pl, err := c.Payload()
-		if err != nil {
-			return nil, err
-		}
-		err = json.Unmarshal(pl, &op)
-		if err != nil {
-			return nil, err
-		}
+		diskIx:   snap.Disk,
+		diskMod:  snap.DiskMod,
+		diskSize: snap.DiskSize,
+	}
+	if f.diskMod.IsZero() {
+		f.diskIx = -1
+	}
+	if f.seqs == nil {
+		f.seqs = make(ot.SeqTable)
+	}
 
-		f.buf, err = op.ApplyTo(f.buf)
+	first, next := store.Bounds()
+	if first > f.nextIx {
+		return nil, errors.New("op log does not continue the snapshot")
+	}
+	msgs, err := store.Range(f.nextIx, next)
+	if err != nil {
+		return nil, err
+	}
+	for _, otmsg := range msgs {
+		f.buf, err = otmsg.Op.ApplyTo(f.buf)
 		if err != nil {
 			return nil, err
 		}
+		f.seqs.Add(otmsg.UID, otmsg.Seq, otmsg.Ix)
 		f.nextIx++
 	}
-	f.consumer = c
-	f.ots = make(chan OtMsg)
-	f.full = make(chan chan []byte)
+	f.ots = make(chan otReq)
+	f.full = make(chan chan BufferMsg)
+	f.hist = make(chan histReq)
+	f.at = make(chan atReq)
+	f.blame = make(chan chan blameRes)
+	f.reloads = make(chan chan reloadRes)
+	f.saves = make(chan chan saveRes)
+	f.resumes = make(chan resumeReq)
+	f.limits = make(chan ot.Limits)
+	f.compact = make(chan compactReq)
 	f.quit = make(chan chan struct{})
 	f.filename = filename
 
+	_, _, err = f.reload()
+	if err != nil {
+		return nil, err
+	}
+	err = f.recover()
+	if err != nil {
+		return nil, err
+	}
+
 	go f.controller()
 
 	return f, nil
 }
 
 func (f *File) controller() {
-	c := f.consumer
 	for {
 		select {
-		case otmsg := <-f.ots:
-			var err error
-			op := otmsg.Op
-			if otmsg.Ix < f.nextIx {
-				seq := otmsg.Ix
-				err = c.Goto(uint64(seq))
-				if err != nil {
-					log.Println(err)
-					f.closeAll()
-					return
-				}
-
-				var oldop ot.Operation
-				for seq < f.nextIx {
-					_, err := c.Next()
-					if err != nil {
-						log.Println(err)
-						f.closeAll()
-						return
-					}
-					pl, err := c.Payload()
-					if err != nil {
-						log.Println(err)
-						f.closeAll()
-						return
-					}
-					err = json.Unmarshal(pl, &oldop)
-					if err != nil {
-						log.Println(err)
-						f.closeAll()
-						return
-					}
-					op = op.After(oldop)
-					seq++
-				}
-			}
-
-			f.buf, err = op.ApplyTo(f.buf)
-			if err != nil {
-				log.Println(err)
-				f.closeAll()
-				return
-			}
-
-			buf, err := json.Marshal(op)
-			if err != nil {
-				log.Println(err)
-				f.closeAll()
-				return
-			}
-			f.otLog.Push(msglog.Msg{From: op.UID}, buf)
-			f.nextIx++
+		case req := <-f.ots:
+			otmsg, dup, err := f.applySeq(req.msg)
+			req.ret <- otRes{otmsg, dup, err}
 
+		case req := <-f.hist:
+			msgs, err := f.history(req.from, req.to)
+			req.ret <- histRes{msgs, err}
+		case req := <-f.at:
+			buf, err := f.contentAt(req.ix)
+			req.ret <- atRes{buf, err}
+		case ret := <-f.blame:
+			lines, err := f.blameLines()
+			ret <- blameRes{lines, err}
+		case ret := <-f.reloads:
+			otmsg, ok, err := f.reload()
+			ret <- reloadRes{otmsg, ok, err}
+		case ret := <-f.saves:
+			ix, err := f.save()
+			ret <- saveRes{ix, err}
+		case req := <-f.resumes:
+			remote, applied, err := f.resume(req.uid, req.ix, req.ops, req.seqs)
+			req.ret <- resumeRes{remote, applied, err}
+		case lim := <-f.limits:
+			f.lim = lim
+		case req := <-f.compact:
+			req.ret <- f.compactLog(req.keep)
 		case ret := <-f.full:
 			retBuf := make([]byte, len(f.buf))
 			copy(retBuf, f.buf)
-			ret <- retBuf
+			ret <- BufferMsg{Ix: f.nextIx, Content: string(retBuf), Saved: f.diskIx}
 		case ret := <-f.quit:
 			f.closeAll()
 			ret <- struct{}{}
@@ -141,12 +243,345 @@ func (f *File) controller() {
 	}
 }
 
-func (f *File) Apply(op ot.Operation, ix int64) {
-	f.ots <- OtMsg{Op: op, Ix: ix}
+// applySeq applies otmsg unless its sequence number shows it has been
+// applied before. Then the op is returned as stored, without Op if it has
+// been compacted.
+func (f *File) applySeq(otmsg OtMsg) (OtMsg, bool, error) {
+	ix, ok := f.seqs.Lookup(otmsg.UID, otmsg.Seq)
+	if !ok {
+		otmsg, err := f.apply(otmsg)
+		return otmsg, false, err
+	}
+	msgs, err := f.history(ix, ix+1)
+	if err != nil {
+		return OtMsg{Ix: ix, UID: otmsg.UID, Seq: otmsg.Seq}, true, nil
+	}
+	return msgs[0], true, nil
+}
+
+// apply transforms otmsg.Op against all ops stored since otmsg.Ix, applies
+// it to the buffer and appends it to the log. Ops which do not apply are
+// rejected with an OpError.
+func (f *File) apply(otmsg OtMsg) (OtMsg, error) {
+	op := otmsg.Op
+	if otmsg.Ix < 0 || otmsg.Ix > f.nextIx {
+		return otmsg, &OpError{otmsg.Ix, errors.New("op references unknown revision")}
+	}
+	oldmsgs, err := f.history(otmsg.Ix, f.nextIx)
+	if err != nil {
+		return otmsg, &OpError{otmsg.Ix, err}
+	}
+	// the length of the buffer at the revision op is based on
+	base := len(f.buf)
+	for _, oldmsg := range oldmsgs {
+		_, del, ins := oldmsg.Op.Count()
+		base += del - ins
+	}
+	err = op.Validate(base)
+	if err != nil {
+		return otmsg, &OpError{otmsg.Ix, err}
+	}
+	for _, oldmsg := range oldmsgs {
+		_, op, err = ot.Transform(oldmsg.Op, op)
+		if err != nil {
+			return otmsg, &OpError{otmsg.Ix, err}
+		}
+	}
+	err = f.lim.Check(op, len(f.buf))
+	if err != nil {
+		return otmsg, &OpError{otmsg.Ix, err}
+	}
+
+	// ApplyTo changes the buffer in place, so it is only called once op
+	// is known to apply and has been stored
+	err = op.ValidateFor(f.buf)
+	if err != nil {
+		return otmsg, &OpError{otmsg.Ix, err}
+	}
+	stored := OtMsg{Ix: f.nextIx, UID: otmsg.UID, Seq: otmsg.Seq, Op: op}
+	err = f.store.Append(stored)
+	if err != nil {
+		return otmsg, err
+	}
+	f.buf, err = op.ApplyTo(f.buf)
+	if err != nil {
+		return otmsg, err
+	}
+	otmsg = stored
+	f.seqs.Add(otmsg.UID, otmsg.Seq, otmsg.Ix)
+	f.nextIx++
+
+	if f.nextIx-f.snapIx >= snapshotInterval {
+		err = f.snapshot()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	return otmsg, nil
+}
+
+// resume rebases the ops a client made on top of revision ix past the
+// history since and applies them in order. The ops of the history are
+// transformed past the client's ops in turn, so the client can bring its
+// document up to date. Ops found in the history by their sequence number
+// have been applied before the client lost its connection and are dropped.
+func (f *File) resume(uid uint64, ix int64, ops []ot.Op, seqs []uint64) ([]ot.Op, []OtMsg, error) {
+	if ix < 0 || ix > f.nextIx {
+		return nil, nil, &OpError{ix, errors.New("op references unknown revision")}
+	}
+	if seqs != nil && len(seqs) != len(ops) {
+		return nil, nil, &OpError{ix, errors.New("sequence numbers do not match the ops")}
+	}
+	missed, err := f.history(ix, f.nextIx)
+	if err != nil {
+		return nil, nil, &OpError{ix, err}
+	}
+
+	// at holds the history index every op has been stored at, -1 for
+	// the ones still to be applied
+	at := make([]int64, len(ops))
+	for i := range ops {
+		at[i] = -1
+		if seqs == nil {
+			continue
+		}
+		if j, ok := f.seqs.Lookup(uid, seqs[i]); ok {
+			if j < ix {
+				return nil, nil, &OpError{ix, errors.New("op applied before the revision it is based on")}
+			}
+			at[i] = j
+		}
+	}
+
+	pending := append([]ot.Op(nil), ops...)
+	remote := make([]ot.Op, 0, len(missed))
+	for _, oldmsg := range missed {
+		if len(pending) > 0 && at[len(ops)-len(pending)] == oldmsg.Ix {
+			// the client has this op already
+			pending = pending[1:]
+			continue
+		}
+		op := oldmsg.Op
+		for i := range pending {
+			op, pending[i], err = ot.Transform(op, pending[i])
+			if err != nil {
+				return nil, nil, &OpError{ix, err}
+			}
+		}
+		remote = append(remote, op)
+	}
+	first := len(ops) - len(pending)
+	for i := first; i < len(ops); i++ {
+		if at[i] >= 0 {
+			return nil, nil, &OpError{ix, errors.New("ops applied out of order")}
+		}
+	}
+
+	// apply all ops to a copy of the buffer before storing any, so they
+	// are applied completely or not at all
+	buf := append([]byte(nil), f.buf...)
+	for _, op := range pending {
+		err = f.lim.Check(op, len(buf))
+		if err == nil {
+			buf, err = op.ApplyTo(buf)
+		}
+		if err != nil {
+			return nil, nil, &OpError{ix, err}
+		}
+	}
+
+	var applied []OtMsg
+	for i, op := range pending {
+		var seq uint64
+		if seqs != nil {
+			seq = seqs[first+i]
+		}
+		otmsg, err := f.apply(OtMsg{Ix: f.nextIx, UID: uid, Seq: seq, Op: op})
+		if err != nil {
+			var oe *OpError
+			if errors.As(err, &oe) {
+				oe.Ix = ix
+			}
+			return remote, applied, err
+		}
+		applied = append(applied, otmsg)
+	}
+	return remote, applied, nil
+}
+
+func (f *File) state() Snapshot {
+	return Snapshot{
+		Ix:       f.nextIx,
+		Content:  append([]byte(nil), f.buf...),
+		Seqs:     f.seqs.Clone(),
+		Disk:     f.diskIx,
+		DiskMod:  f.diskMod,
+		DiskSize: f.diskSize,
+	}
+}
+
+func (f *File) snapshot() error {
+	err := f.store.WriteSnapshot(f.state())
+	if err != nil {
+		return err
+	}
+	f.snapIx = f.nextIx
+	return nil
+}
+
+// compactLog drops the ops before history index keep from the store after
+// writing a snapshot to start from.
+func (f *File) compactLog(keep int64) error {
+	if keep > f.nextIx {
+		return errors.New("history range out of bounds")
+	}
+	if f.snapIx < keep {
+		err := f.snapshot()
+		if err != nil {
+			return err
+		}
+	}
+	return f.store.Truncate(keep)
+}
+
+func (f *File) history(from, to int64) ([]OtMsg, error) {
+	return f.store.Range(from, to)
+}
+
+// contentAt reverts the ops since history index ix on a copy of the buffer.
+func (f *File) contentAt(ix int64) ([]byte, error) {
+	msgs, err := f.history(ix, f.nextIx)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, len(f.buf))
+	copy(buf, f.buf)
+	for i := len(msgs) - 1; i >= 0; i-- {
+		buf, err = msgs[i].Op.Inverse().ApplyTo(buf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func (f *File) blameLines() ([]BlameLine, error) {
+	first, _ := f.store.Bounds()
+	base, err := f.contentAt(first)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := f.history(first, f.nextIx)
+	if err != nil {
+		return nil, err
+	}
+	return Blame(base, msgs)
+}
+
+// Apply stores an op by uid based on revision ix. It returns the op
+// transformed against the history together with its history index.
+func (f *File) Apply(uid uint64, ix int64, op ot.Op) (OtMsg, error) {
+	otmsg, _, err := f.ApplySeq(uid, 0, ix, op)
+	return otmsg, err
+}
+
+// ApplySeq is Apply for an op its client numbered seq. An op which has been
+// applied before is not applied again, dup is set and otmsg is the op as it
+// was stored. The sequence numbers are kept in the log, so duplicates are
+// recognized after the file has been reopened.
+func (f *File) ApplySeq(uid, seq uint64, ix int64, op ot.Op) (otmsg OtMsg, dup bool, err error) {
+	ret := make(chan otRes)
+	f.ots <- otReq{msg: OtMsg{Ix: ix, UID: uid, Seq: seq, Op: op}, ret: ret}
+	res := <-ret
+	return res.msg, res.dup, res.err
+}
+
+// History returns the ops stored at the history indices from up to, but not
+// including, to, together with their authors.
+func (f *File) History(from, to int64) ([]OtMsg, error) {
+	ret := make(chan histRes)
+	f.hist <- histReq{from: from, to: to, ret: ret}
+	res := <-ret
+	return res.msgs, res.err
+}
+
+// At returns the content of the file at revision ix, that is before the op
+// with history index ix was applied.
+func (f *File) At(ix int64) ([]byte, error) {
+	ret := make(chan atRes)
+	f.at <- atReq{ix: ix, ret: ret}
+	res := <-ret
+	return res.buf, res.err
+}
+
+// Blame attributes every line of the file to the op which last inserted
+// text into it.
+func (f *File) Blame() ([]BlameLine, error) {
+	ret := make(chan blameRes)
+	f.blame <- ret
+	res := <-ret
+	return res.lines, res.err
+}
+
+// Resume brings a client back in sync which lost its connection at revision
+// ix with ops, each based on the one before, not yet acknowledged. seqs
+// holds the sequence number of every op, or is nil if they are not
+// numbered. The ops are rebased and applied in order by uid, except for the
+// ones found to have been applied already, and returned as applied. remote
+// holds the ops the client has missed, to be applied to its document in
+// order. If the history since ix is gone, it fails with an OpError wrapping
+// ErrCompacted and the client has to rebase its ops on the current content.
+func (f *File) Resume(uid uint64, ix int64, ops []ot.Op, seqs []uint64) (remote []ot.Op, applied []OtMsg, err error) {
+	ret := make(chan resumeRes)
+	f.resumes <- resumeReq{uid: uid, ix: ix, ops: ops, seqs: seqs, ret: ret}
+	res := <-ret
+	return res.remote, res.applied, res.err
+}
+
+// SetLimits bounds the size of the ops applied from now on and of the file
+// they produce. Ops exceeding the limits are rejected with an OpError
+// wrapping ot.ErrTooLarge. Merging modifications made on disk is not
+// limited.
+func (f *File) SetLimits(lim ot.Limits) {
+	f.limits <- lim
+}
+
+// Compact drops all ops before history index keep from the log. keep should
+// be the oldest revision any client can still base an op on.
+func (f *File) Compact(keep int64) error {
+	ret := make(chan error)
+	f.compact <- compactReq{keep: keep, ret: ret}
+	return <-ret
+}
+
+// Reload merges modifications made to the file on disk by other programs
+// into the buffer. If ok is true, otmsg is the op by DiskUID which has been
+// applied.
+func (f *File) Reload() (otmsg OtMsg, ok bool, err error) {
+	ret := make(chan reloadRes)
+	f.reloads <- ret
+	res := <-ret
+	return res.msg, res.ok, res.err
+}
+
+// Save writes the file to disk and returns the revision saved. It fails with
+// ErrModifiedOnDisk instead of overwriting modifications made by other
+// programs, which have to be merged with Reload first.
+func (f *File) Save() (int64, error) {
+	ret := make(chan saveRes)
+	f.saves <- ret
+	res := <-ret
+	return res.ix, res.err
 }
 
 func (f *File) Bytes() []byte {
-	ret := make(chan []byte)
+	return []byte(f.Current().Content)
+}
+
+// Current returns the content of the file together with its revision.
+func (f *File) Current() BufferMsg {
+	ret := make(chan BufferMsg)
 	f.full <- ret
 	return <-ret
 }
@@ -157,11 +592,23 @@ func (f *File) Close() {
 	<-ret
 }
 
+// closeAll merges modifications made on disk before writing the buffer, so
+// they are not overwritten. Files already up to date on disk are left
+// untouched.
 func (f *File) closeAll() {
-	f.consumer.Close()
-	f.otLog.Close()
-	err := ioutil.WriteFile(f.filename, f.buf, 0744)
+	_, _, err := f.reload()
+	if err != nil {
+		log.Println(err)
+	}
+	if f.diskIx != f.nextIx {
+		err = f.writeFile()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	err = f.snapshot()
 	if err != nil {
 		log.Println(err)
 	}
+	f.store.Close()
 }
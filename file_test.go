@@ -1,8 +1,13 @@
 package weeded
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/dane-unltd/weeded/ot"
 )
@@ -13,24 +18,698 @@ func TestFile(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	op := ot.Operation{
-		OpType: ot.Insert,
-		Blocks: []ot.Block{
-			{Pos: 0, Text: []byte("Hello World!\n")},
-		},
+	op := ot.Op{}.Insert("Hello World!\n")
+
+	_, err = f.Apply(1, 0, op)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op = ot.Op{}.Retain(6).Insert("wide ").Retain(7)
+
+	_, err = f.Apply(2, 1, op)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	f.Apply(op, 0)
+	fmt.Println(string(f.Bytes()))
+	f.Close()
+}
 
-	op = ot.Operation{
-		OpType: ot.Insert,
-		Blocks: []ot.Block{
-			{Pos: 6, Text: []byte("wide ")},
+func TestFileCompact(t *testing.T) {
+	mems := make(map[string]*MemStore)
+	stores := map[string]func(name string) (*File, error){
+		"msglog": NewFile,
+		"flat": func(name string) (*File, error) {
+			store, err := NewFlatStore(name)
+			if err != nil {
+				return nil, err
+			}
+			return OpenFile(name, store)
 		},
+		"mem": func(name string) (*File, error) {
+			if mems[name] == nil {
+				mems[name] = NewMemStore()
+			}
+			return OpenFile(name, mems[name])
+		},
+	}
+	for store, open := range stores {
+		t.Run(store, func(t *testing.T) { testFileCompact(t, open) })
+		t.Run(store+"/crash", func(t *testing.T) { testFileCompactCrash(t, open) })
 	}
+}
 
-	f.Apply(op, 1)
+func testFileCompactCrash(t *testing.T, open func(name string) (*File, error)) {
+	dir, err := ioutil.TempDir("", "weeded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "test.txt")
 
-	fmt.Println(string(f.Bytes()))
+	f, err := open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range []string{"a", "b", "c", "d"} {
+		_, err = f.Apply(1, int64(i), ot.Op{}.Retain(i).Insert(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = f.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// edits made in place must not change the snapshot
+	_, err = f.Apply(1, 4, ot.Op{}.Delete("a").Retain(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Apply(1, 5, ot.Op{}.Retain(3).Insert("e"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Compact(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the daemon crashed without closing f
+	f, err = open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cur := f.Current()
+	if cur.Ix != 6 || cur.Content != "bcde" {
+		t.Errorf("got %q at %d after recovering", cur.Content, cur.Ix)
+	}
+}
+
+func testFileCompact(t *testing.T, open func(name string) (*File, error)) {
+	dir, err := ioutil.TempDir("", "weeded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "test.txt")
+
+	f, err := open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range []string{"a", "b", "c", "d"} {
+		_, err = f.Apply(1, int64(i), ot.Op{}.Retain(i).Insert(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = f.Compact(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.History(1, 4); err == nil {
+		t.Error("history before compaction point")
+	}
+	_, err = f.Apply(2, 2, ot.Op{}.Retain(2).Insert("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
 	f.Close()
+
+	f, err = open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cur := f.Current()
+	if cur.Ix != 5 || cur.Content != "abcdx" {
+		t.Errorf("got %q at %d after reopening", cur.Content, cur.Ix)
+	}
+	msgs, err := f.History(2, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 3 || msgs[2].UID != 2 {
+		t.Error("unexpected history", msgs)
+	}
+
+	buf, err := f.At(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "abc" {
+		t.Errorf("got %q at revision 3", buf)
+	}
+	if string(f.Bytes()) != "abcdx" {
+		t.Error("At modified the file")
+	}
+}
+
+func TestFileReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weeded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "test.txt")
+
+	err = ioutil.WriteFile(name, []byte("Hello World!\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(f.Bytes()) != "Hello World!\n" {
+		t.Fatalf("got %q after opening", f.Bytes())
+	}
+
+	_, err = f.Apply(1, 1, ot.Op{}.Retain(12).Insert(" and stuff").Retain(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(name, []byte("Hello wide World!\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	err = os.Chtimes(name, later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otmsg, ok, err := f.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || otmsg.UID != DiskUID || otmsg.Ix != 2 {
+		t.Error("unexpected reload", otmsg, ok)
+	}
+	f.Close()
+
+	want := "Hello wide World! and stuff\n"
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != want {
+		t.Errorf("got %q, want %q", buf, want)
+	}
+}
+
+func TestFileReloadCompacted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weeded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "test.txt")
+
+	err = ioutil.WriteFile(name, []byte("Hello World!\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.Apply(1, 1, ot.Op{}.Retain(12).Insert(" and stuff").Retain(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Compact(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(name, []byte("Hello wide World!\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	err = os.Chtimes(name, later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok, err := f.Reload()
+	if !errors.Is(err, ErrModifiedOnDisk) || ok {
+		t.Fatal("reloaded without the revision on disk:", err)
+	}
+	if string(f.Bytes()) != "Hello World! and stuff\n" {
+		t.Errorf("got %q after a failed reload", f.Bytes())
+	}
+	if _, err = f.Save(); err != ErrModifiedOnDisk {
+		t.Error("overwrote modification on disk:", err)
+	}
+}
+
+func TestStoreFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weeded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "test.txt")
+
+	f, err := NewFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Apply(1, 0, ot.Op{}.Insert("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	// belongs to another file
+	err = ioutil.WriteFile(name+".x.master.weeded", nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := StoreFiles(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{name + ".snapshot.weeded", name + ".master.weeded"}
+	if len(files) != len(want) || files[0] != want[0] || files[1] != want[1] {
+		t.Error("got", files)
+	}
+}
+
+func TestFileRecover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weeded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "test.txt")
+
+	err = ioutil.WriteFile(name, []byte("Hello World!\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := NewMemStore()
+	f, err := OpenFile(name, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Apply(1, 1, ot.Op{}.Retain(6).Insert("wide ").Retain(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the daemon crashed without closing f
+	f, err = OpenFile(name, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "Hello wide World!\n" {
+		t.Errorf("got %q after recovering", buf)
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Error("mode not kept:", fi.Mode())
+	}
+}
+
+func TestFileSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weeded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "test.txt")
+
+	err = ioutil.WriteFile(name, []byte("Hello World!\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := OpenFile(name, NewMemStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if cur := f.Current(); cur.Saved != cur.Ix {
+		t.Errorf("saved %d, want %d after opening", cur.Saved, cur.Ix)
+	}
+
+	_, err = f.Apply(1, 1, ot.Op{}.Retain(6).Insert("wide ").Retain(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix, err := f.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ix != 2 || string(buf) != "Hello wide World!\n" {
+		t.Errorf("saved %q at %d", buf, ix)
+	}
+
+	_, err = f.Apply(1, 2, ot.Op{}.Delete("Hello ").Retain(12))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(name, []byte("Hello wide World!\nBye\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	err = os.Chtimes(name, later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Save(); err != ErrModifiedOnDisk {
+		t.Error("overwrote modification on disk:", err)
+	}
+	if _, _, err = f.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	ix, err = f.Save()
+	if err != nil || ix != 4 {
+		t.Error("saved", ix, err)
+	}
+}
+
+func TestFileResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weeded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "test.txt")
+
+	err = ioutil.WriteFile(name, []byte("Hello World!\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := OpenFile(name, NewMemStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// the client made two ops at revision 1 while another one was applied
+	_, err = f.Apply(2, 1, ot.Op{}.Retain(6).Insert("wide ").Retain(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := []byte("Oh, Hello World!\nBye\n")
+	ops := []ot.Op{
+		ot.Op{}.Insert("Oh, ").Retain(13),
+		ot.Op{}.Retain(17).Insert("Bye\n"),
+	}
+	remote, applied, err := f.Resume(1, 1, ops, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 2 || applied[0].Ix != 2 || applied[1].UID != 1 {
+		t.Errorf("resumed ops stored as %v", applied)
+	}
+	for _, op := range remote {
+		local, err = op.ApplyTo(local)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cur := f.Current()
+	if string(local) != cur.Content || cur.Content != "Oh, Hello wide World!\nBye\n" {
+		t.Errorf("client has %q, file %q", local, cur.Content)
+	}
+
+	err = f.Compact(cur.Ix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = f.Resume(1, 1, nil, nil)
+	var oe *OpError
+	if !errors.Is(err, ErrCompacted) || !errors.As(err, &oe) || oe.Ix != 1 {
+		t.Error("resumed from compacted history:", err)
+	}
+}
+
+func TestFileResumeSeq(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weeded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "test.txt")
+
+	err = ioutil.WriteFile(name, []byte("hello"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := OpenFile(name, NewMemStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// the first op of the client is applied, but its acknowledgement is
+	// lost together with the connection
+	ops := []ot.Op{
+		ot.Op{}.Retain(5).Insert(" world"),
+		ot.Op{}.Retain(11).Insert("!"),
+	}
+	seqs := []uint64{1, 2}
+	_, _, err = f.ApplySeq(1, 1, 1, ops[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Apply(2, 2, ot.Op{}.Insert("Oh, ").Retain(11))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local := []byte("hello world!")
+	remote, applied, err := f.Resume(1, 1, ops, seqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 1 || applied[0].Seq != 2 {
+		t.Errorf("resumed ops stored as %v", applied)
+	}
+	for _, op := range remote {
+		local, err = op.ApplyTo(local)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cur := f.Current()
+	if string(local) != cur.Content || cur.Content != "Oh, hello world!" {
+		t.Errorf("client has %q, file %q", local, cur.Content)
+	}
+
+	// the reply to the resume is lost as well
+	local = []byte("hello world!")
+	remote, applied, err = f.Resume(1, 1, ops, seqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 0 {
+		t.Errorf("ops applied twice: %v", applied)
+	}
+	for _, op := range remote {
+		local, err = op.ApplyTo(local)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cur = f.Current()
+	if string(local) != cur.Content || cur.Content != "Oh, hello world!" {
+		t.Errorf("client has %q, file %q", local, cur.Content)
+	}
+
+	// ops are checked before any of them is applied
+	_, _, err = f.Resume(1, cur.Ix, []ot.Op{ot.Op{}.Retain(16).Insert("?"), ot.Op{}.Retain(3)}, []uint64{3, 4})
+	if err == nil || f.Current().Ix != cur.Ix {
+		t.Error("invalid resume applied:", err)
+	}
+	_, _, err = f.Resume(1, cur.Ix, []ot.Op{ot.Op{}.Retain(16).Insert("?"), ot.Op{}.Retain(4).Delete("xyz").Retain(10)}, []uint64{5, 6})
+	if err == nil || f.Current().Content != cur.Content {
+		t.Errorf("resume deleting text not found applied as %q: %v", f.Current().Content, err)
+	}
+}
+
+func TestFileApplySeq(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weeded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "test.txt")
+
+	err = ioutil.WriteFile(name, []byte("Hello World!\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := NewMemStore()
+	f, err := OpenFile(name, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := ot.Op{}.Retain(6).Insert("wide ").Retain(7)
+	otmsg, dup, err := f.ApplySeq(1, 5, 1, op)
+	if err != nil || dup {
+		t.Fatal(dup, err)
+	}
+
+	// the op is left out once it has been dropped from the log
+	check := func(f *File, logged bool) {
+		again, dup, err := f.ApplySeq(1, 5, 1, op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !dup || again.Ix != otmsg.Ix || logged && !again.Op.Equals(otmsg.Op) {
+			t.Errorf("op applied again as %v", again)
+		}
+		if cur := f.Current(); cur.Content != "Hello wide World!\n" {
+			t.Errorf("got %q", cur.Content)
+		}
+	}
+	check(f, true)
+
+	// the sequence numbers are read back from the log
+	f, err = OpenFile(name, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(f, true)
+
+	// and from the snapshot
+	f.Close()
+	store, err := NewFlatStore(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.WriteSnapshot(mem.snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	store, err = NewFlatStore(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err = OpenFile(name, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	check(f, false)
+}
+
+func TestFileBadOp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weeded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "test.txt")
+
+	err = ioutil.WriteFile(name, []byte("Hello World!\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := OpenFile(name, NewMemStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, ix := range []int64{1, 5} {
+		_, err = f.Apply(1, ix, ot.Op{}.Retain(100).Insert("!"))
+		oe, ok := err.(*OpError)
+		if !ok || oe.Ix != ix {
+			t.Fatalf("bad op at %d rejected with %v", ix, err)
+		}
+	}
+
+	_, err = f.Apply(1, 1, ot.Op{{N: -3}, {N: 10}})
+	if !errors.Is(err, ot.ErrMalformed) {
+		t.Error("malformed op rejected with", err)
+	}
+	f.SetLimits(ot.Limits{MaxOpSize: 6})
+	_, err = f.Apply(1, 1, ot.Op{}.Retain(6).Insert("very wide ").Retain(7))
+	if !errors.Is(err, ot.ErrTooLarge) {
+		t.Error("op exceeding the limits rejected with", err)
+	}
+
+	// the file is still open for everybody else
+	otmsg, err := f.Apply(2, 1, ot.Op{}.Retain(6).Insert("wide ").Retain(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur := f.Current(); otmsg.Ix != 1 || cur.Content != "Hello wide World!\n" {
+		t.Errorf("got %q after op %d", cur.Content, otmsg.Ix)
+	}
+}
+
+// failStore is a MemStore whose Append fails while fail is set.
+type failStore struct {
+	*MemStore
+	fail bool
+}
+
+func (s *failStore) Append(otmsg OtMsg) error {
+	if s.fail {
+		return errors.New("disk full")
+	}
+	return s.MemStore.Append(otmsg)
+}
+
+func TestFileStoreError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weeded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "test.txt")
+
+	err = ioutil.WriteFile(name, []byte("XYZWefgh"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &failStore{MemStore: NewMemStore()}
+	f, err := OpenFile(name, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// an op keeping the length of the buffer is applied in place
+	store.fail = true
+	_, err = f.Apply(1, 1, ot.Op{}.Insert("Q").Retain(7).Delete("h"))
+	if err == nil {
+		t.Fatal("op applied without being stored")
+	}
+	if cur := f.Current(); cur.Content != "XYZWefgh" || cur.Ix != 1 {
+		t.Errorf("got %q at %d after failing to store an op", cur.Content, cur.Ix)
+	}
+
+	store.fail = false
+	_, err = f.Apply(1, 1, ot.Op{}.Insert("Q").Retain(7).Delete("h"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur := f.Current(); cur.Content != "QXYZWefg" || cur.Ix != 2 {
+		t.Errorf("got %q at %d", cur.Content, cur.Ix)
+	}
 }
@@ -0,0 +1,204 @@
+package weeded
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// FlatStore is an embedded store keeping all ops of a file in a single
+// file of length prefixed records. The offsets of the records are indexed
+// in memory when the store is opened.
+type FlatStore struct {
+	filename string
+
+	f       *os.File
+	offsets []int64
+	size    int64
+	first   int64
+	snap    Snapshot
+}
+
+func NewFlatStore(filename string) (*FlatStore, error) {
+	s := &FlatStore{filename: filename}
+	err := readJSON(s.snapName(), &s.snap)
+	if err != nil {
+		return nil, err
+	}
+	s.first = s.snap.Ix
+	err = s.open()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FlatStore) opsName() string {
+	return s.filename + ".ops.weeded"
+}
+
+func (s *FlatStore) snapName() string {
+	return s.filename + ".flat.weeded"
+}
+
+// open opens the ops file and indexes its records. A record cut short by a
+// crash is dropped.
+func (s *FlatStore) open() error {
+	f, err := os.OpenFile(s.opsName(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	s.f = f
+	s.offsets = s.offsets[:0]
+	s.size = 0
+
+	r := bufio.NewReader(f)
+	for {
+		otmsg, n, err := readRecord(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if len(s.offsets) == 0 {
+			s.first = otmsg.Ix
+		}
+		s.offsets = append(s.offsets, s.size)
+		s.size += int64(n)
+	}
+	err = f.Truncate(s.size)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	_, err = f.Seek(s.size, 0)
+	return err
+}
+
+// readRecord reads a record and returns the op it holds together with the
+// size of the record.
+func readRecord(r *bufio.Reader) (OtMsg, int, error) {
+	var otmsg OtMsg
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return otmsg, 0, err
+	}
+	buf := make([]byte, n)
+	_, err = io.ReadFull(r, buf)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return otmsg, 0, err
+	}
+	otmsg, err = decodeOtMsg(buf)
+	var lbuf [binary.MaxVarintLen64]byte
+	return otmsg, binary.PutUvarint(lbuf[:], n) + int(n), err
+}
+
+func encodeRecord(otmsg OtMsg) ([]byte, error) {
+	pl, err := otmsg.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(pl))
+	n := binary.PutUvarint(buf, uint64(len(pl)))
+	return append(buf[:n], pl...), nil
+}
+
+func (s *FlatStore) Append(otmsg OtMsg) error {
+	_, next := s.Bounds()
+	if otmsg.Ix != next {
+		return errors.New("op does not continue the log")
+	}
+	rec, err := encodeRecord(otmsg)
+	if err != nil {
+		return err
+	}
+	_, err = s.f.Write(rec)
+	if err != nil {
+		return err
+	}
+	s.offsets = append(s.offsets, s.size)
+	s.size += int64(len(rec))
+	return nil
+}
+
+func (s *FlatStore) Range(from, to int64) ([]OtMsg, error) {
+	first, next := s.Bounds()
+	if from < first {
+		return nil, ErrCompacted
+	}
+	if from > to || to > next {
+		return nil, errors.New("history range out of bounds")
+	}
+	if from == to {
+		return nil, nil
+	}
+	r := bufio.NewReader(io.NewSectionReader(s.f, s.offsets[from-first], s.size-s.offsets[from-first]))
+	msgs := make([]OtMsg, 0, to-from)
+	for ix := from; ix < to; ix++ {
+		otmsg, _, err := readRecord(r)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, otmsg)
+	}
+	return msgs, nil
+}
+
+func (s *FlatStore) Bounds() (first, next int64) {
+	return s.first, s.first + int64(len(s.offsets))
+}
+
+func (s *FlatStore) Snapshot() (Snapshot, error) {
+	return s.snap, nil
+}
+
+func (s *FlatStore) WriteSnapshot(snap Snapshot) error {
+	err := writeJSON(s.snapName(), snap)
+	if err != nil {
+		return err
+	}
+	s.snap = snap
+	return nil
+}
+
+// Truncate rewrites the ops file with the ops to keep only.
+func (s *FlatStore) Truncate(keep int64) error {
+	if keep <= s.first {
+		return nil
+	}
+	if keep > s.snap.Ix {
+		return errors.New("truncating past the latest snapshot")
+	}
+	_, next := s.Bounds()
+	var buf []byte
+	if keep < next {
+		off := s.offsets[keep-s.first]
+		buf = make([]byte, s.size-off)
+		_, err := s.f.ReadAt(buf, off)
+		if err != nil {
+			return err
+		}
+	}
+	err := writeFileAtomic(s.opsName(), buf, 0644)
+	if err != nil {
+		return err
+	}
+	s.f.Close()
+	s.first = keep
+	return s.open()
+}
+
+func (s *FlatStore) Close() error {
+	err := s.f.Sync()
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
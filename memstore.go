@@ -0,0 +1,69 @@
+package weeded
+
+import (
+	"errors"
+)
+
+// MemStore keeps ops and snapshots in memory only. A MemStore can be
+// reopened by another File after being closed.
+type MemStore struct {
+	snap  Snapshot
+	first int64
+	msgs  []OtMsg
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{}
+}
+
+func (s *MemStore) Append(otmsg OtMsg) error {
+	_, next := s.Bounds()
+	if otmsg.Ix != next {
+		return errors.New("op does not continue the log")
+	}
+	s.msgs = append(s.msgs, otmsg)
+	return nil
+}
+
+func (s *MemStore) Range(from, to int64) ([]OtMsg, error) {
+	first, next := s.Bounds()
+	if from < first {
+		return nil, ErrCompacted
+	}
+	if from > to || to > next {
+		return nil, errors.New("history range out of bounds")
+	}
+	msgs := make([]OtMsg, to-from)
+	copy(msgs, s.msgs[from-first:to-first])
+	return msgs, nil
+}
+
+func (s *MemStore) Bounds() (first, next int64) {
+	return s.first, s.first + int64(len(s.msgs))
+}
+
+func (s *MemStore) Snapshot() (Snapshot, error) {
+	return s.snap, nil
+}
+
+func (s *MemStore) WriteSnapshot(snap Snapshot) error {
+	snap.Content = append([]byte(nil), snap.Content...)
+	s.snap = snap
+	return nil
+}
+
+func (s *MemStore) Truncate(keep int64) error {
+	if keep <= s.first {
+		return nil
+	}
+	if keep > s.snap.Ix {
+		return errors.New("truncating past the latest snapshot")
+	}
+	s.msgs = append([]OtMsg(nil), s.msgs[keep-s.first:]...)
+	s.first = keep
+	return nil
+}
+
+func (s *MemStore) Close() error {
+	return nil
+}
@@ -0,0 +1,158 @@
+package weeded
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/dane-unltd/weeded/ot"
+)
+
+type MsgID string
+
+// Msg is the envelope of all messages. Doc is the document of a connection
+// the message refers to, as returned in the "buffer" reply to "open". It is
+// 0 for messages about the connection or the workspace, and may be left out
+// by clients with a single open document.
+type Msg struct {
+	ID   MsgID
+	Doc  uint64 `json:",omitempty"`
+	Data *json.RawMessage
+
+	// bin is set if Data holds a binary encoding instead of JSON.
+	bin bool
+}
+
+// OtMsg carries an operation between clients and the daemon. Sent by a
+// client, Ix is the revision the op is based on. Sent by the daemon, Ix is
+// the history index the op was stored at and UID its author. Seq is the
+// number the client assigned to the op, so it is acknowledged instead of
+// applied again if sent twice, 0 if none. Connections of the same user
+// share a UID, so clients should count up from a random start. See
+// ot.SeqTable.
+type OtMsg struct {
+	Ix  int64
+	UID uint64
+	Seq uint64 `json:",omitempty"`
+	Op  ot.Op
+}
+
+// BufferMsg is a full snapshot of a buffer at revision Ix. As reply to
+// "open", Path is the file relative to the workspace root. Saved is the
+// revision last written to disk, -1 if unknown. The buffer is clean if it
+// equals Ix.
+type BufferMsg struct {
+	Ix      int64
+	Content string
+	Path    string `json:",omitempty"`
+	Saved   int64
+}
+
+// ResumeMsg reopens a document after the connection to the daemon was
+// lost. The client sends it as "resume" with Doc set to the document ID it
+// used before, or 0 for a new one. Ix is the last revision it received and
+// Ops are its ops not yet acknowledged, each based on the one before. Seqs
+// holds the sequence number of every op in Ops, as sent in OtMsg.Seq, so an
+// op whose acknowledgement was lost is not applied again. Ops are matched by
+// the uid of their author, which only stays the same across connections
+// identified as the same user.
+//
+// The daemon applies Ops in order and replies with "resume", where Ix is
+// the revision the client is at after applying Ops, the ops it missed
+// transformed past its own. Saved is as in BufferMsg. If the history since
+// Ix has been compacted, Ops are not applied: the daemon reports an error
+// with CodeCompacted, followed by "buffer" to rebase them on.
+type ResumeMsg struct {
+	Path  string
+	Ix    int64
+	Ops   []ot.Op
+	Seqs  []uint64 `json:",omitempty"`
+	Saved int64
+}
+
+// CursorMsg shares the selection of user UID at revision Ix.
+type CursorMsg struct {
+	Ix  int64
+	UID uint64
+	Sel ot.Selection
+}
+
+// HistoryMsg requests the ops between the revisions From and To. The reply
+// also carries the content at revision From, so every revision in between
+// can be rebuilt by applying Ops in order.
+type HistoryMsg struct {
+	From    int64
+	To      int64
+	Content string
+	Ops     []OtMsg
+}
+
+// ErrorCode classifies the errors reported to clients.
+type ErrorCode string
+
+const (
+	// CodeBadRequest is a message which cannot be decoded or is not
+	// valid in the state of the connection.
+	CodeBadRequest ErrorCode = "bad-request"
+	// CodeBadOp is an op which cannot be applied to its revision.
+	CodeBadOp ErrorCode = "bad-op"
+	// CodeUnknownDocument is a message for a document not open on the
+	// connection.
+	CodeUnknownDocument ErrorCode = "unknown-document"
+	// CodePermission is a request the user lacks the access for.
+	CodePermission ErrorCode = "permission-denied"
+	// CodeReadOnly is an op sent for a file the user can only read.
+	CodeReadOnly ErrorCode = "read-only"
+	// CodeLimit is a request exceeding a limit of the daemon, such as
+	// the size of a document or the rate of ops.
+	CodeLimit    ErrorCode = "limit-exceeded"
+	CodeNotFound ErrorCode = "not-found"
+	CodeExists   ErrorCode = "exists"
+	// CodeConflict is a request which collides with the state of a file,
+	// as it is open or has been modified on disk.
+	CodeConflict ErrorCode = "conflict"
+	// CodeCompacted is a "resume" from a revision whose history has been
+	// dropped. Ix is the revision the pending ops were based on. The
+	// "buffer" sent next holds the current content, which the client has
+	// to rebase its pending ops on before sending them again.
+	CodeCompacted ErrorCode = "history-compacted"
+	CodeInternal  ErrorCode = "internal"
+)
+
+// ErrorMsg reports a request which failed to the connection which sent it,
+// as "error" with Doc set to the document it refers to. For a rejected op,
+// Ix is the revision the op was based on, otherwise -1. The document stays
+// usable after any error.
+type ErrorMsg struct {
+	Code    ErrorCode
+	Message string
+	Ix      int64
+}
+
+// Entry describes a file or directory in the workspace. Path is relative to
+// the workspace root and separated by slashes.
+type Entry struct {
+	Path    string
+	Dir     bool
+	Size    int64
+	ModTime time.Time
+}
+
+// ListMsg requests the tree below the directory Path. The reply holds all
+// files and directories below it.
+type ListMsg struct {
+	Path    string
+	Entries []Entry
+}
+
+// TreeMsg changes the workspace tree. Clients send it as "create", "rename"
+// or "delete". Once done, it is broadcast to all clients as "tree" with Op
+// set to the ID of the request.
+//
+// Dir asks "create" for a directory instead of an empty file. To is the new
+// path for "rename".
+type TreeMsg struct {
+	Op   MsgID
+	Path string
+	To   string
+	Dir  bool
+}
@@ -0,0 +1,213 @@
+package weeded
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/dane-unltd/msglog"
+)
+
+// MsglogStore keeps the ops of a file in a msglog next to it. Truncating
+// the log starts a new generation of it, the generation in use is recorded
+// along with the snapshot.
+type MsglogStore struct {
+	filename string
+
+	otLog    *msglog.Log
+	consumer *msglog.Consumer
+	meta     msglogMeta
+	first    int64
+	next     int64
+}
+
+type msglogMeta struct {
+	Snapshot
+	Log int
+}
+
+func NewMsglogStore(filename string) (*MsglogStore, error) {
+	s := &MsglogStore{filename: filename}
+	err := readJSON(s.metaName(), &s.meta)
+	if err != nil {
+		return nil, err
+	}
+	s.otLog, err = msglog.Recover(s.logName(s.meta.Log))
+	if err != nil {
+		return nil, err
+	}
+	s.consumer, err = s.otLog.Consumer()
+	if err != nil {
+		s.otLog.Close()
+		return nil, err
+	}
+
+	s.first = s.meta.Ix
+	s.next = s.meta.Ix
+	for n := 0; s.consumer.HasNext(); n++ {
+		otmsg, err := readOtMsg(s.consumer)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		if n == 0 {
+			s.first = otmsg.Ix
+		}
+		s.next = otmsg.Ix + 1
+	}
+	return s, nil
+}
+
+func (s *MsglogStore) metaName() string {
+	return s.filename + ".snapshot.weeded"
+}
+
+func (s *MsglogStore) logName(gen int) string {
+	if gen == 0 {
+		return s.filename + ".master.weeded"
+	}
+	return fmt.Sprintf("%s.master.%d.weeded", s.filename, gen)
+}
+
+func readOtMsg(c *msglog.Consumer) (OtMsg, error) {
+	var otmsg OtMsg
+	_, err := c.Next()
+	if err != nil {
+		return otmsg, err
+	}
+	pl, err := c.Payload()
+	if err != nil {
+		return otmsg, err
+	}
+	return decodeOtMsg(pl)
+}
+
+func pushOtMsg(l *msglog.Log, otmsg OtMsg) error {
+	buf, err := otmsg.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	l.Push(msglog.Msg{From: otmsg.UID}, buf)
+	return nil
+}
+
+func (s *MsglogStore) Append(otmsg OtMsg) error {
+	if otmsg.Ix != s.next {
+		return errors.New("op does not continue the log")
+	}
+	err := pushOtMsg(s.otLog, otmsg)
+	if err != nil {
+		return err
+	}
+	s.next++
+	return nil
+}
+
+func (s *MsglogStore) Range(from, to int64) ([]OtMsg, error) {
+	if from < s.first {
+		return nil, ErrCompacted
+	}
+	if from > to || to > s.next {
+		return nil, errors.New("history range out of bounds")
+	}
+	if from == to {
+		return nil, nil
+	}
+	err := s.consumer.Goto(uint64(from - s.first))
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]OtMsg, 0, to-from)
+	for ix := from; ix < to; ix++ {
+		otmsg, err := readOtMsg(s.consumer)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, otmsg)
+	}
+	return msgs, nil
+}
+
+func (s *MsglogStore) Bounds() (first, next int64) {
+	return s.first, s.next
+}
+
+func (s *MsglogStore) Snapshot() (Snapshot, error) {
+	return s.meta.Snapshot, nil
+}
+
+func (s *MsglogStore) WriteSnapshot(snap Snapshot) error {
+	meta := msglogMeta{Snapshot: snap, Log: s.meta.Log}
+	err := writeJSON(s.metaName(), meta)
+	if err != nil {
+		return err
+	}
+	s.meta = meta
+	return nil
+}
+
+// Truncate copies the ops to keep into the next generation of the log. The
+// snapshot referencing the new generation is the point at which it takes
+// over.
+func (s *MsglogStore) Truncate(keep int64) error {
+	if keep <= s.first {
+		return nil
+	}
+	if keep > s.meta.Ix {
+		return errors.New("truncating past the latest snapshot")
+	}
+	msgs, err := s.Range(keep, s.next)
+	if err != nil {
+		return err
+	}
+
+	gen := s.meta.Log + 1
+	name := s.logName(gen)
+	err = os.RemoveAll(name)
+	if err != nil {
+		return err
+	}
+	l, err := msglog.Recover(name)
+	if err != nil {
+		return err
+	}
+	for _, otmsg := range msgs {
+		err = pushOtMsg(l, otmsg)
+		if err != nil {
+			l.Close()
+			return err
+		}
+	}
+	c, err := l.Consumer()
+	if err != nil {
+		l.Close()
+		return err
+	}
+
+	meta := msglogMeta{Snapshot: s.meta.Snapshot, Log: gen}
+	err = writeJSON(s.metaName(), meta)
+	if err != nil {
+		c.Close()
+		l.Close()
+		return err
+	}
+
+	s.consumer.Close()
+	s.otLog.Close()
+	err = os.RemoveAll(s.logName(s.meta.Log))
+	if err != nil {
+		log.Println(err)
+	}
+	s.otLog = l
+	s.consumer = c
+	s.meta = meta
+	s.first = keep
+	return nil
+}
+
+func (s *MsglogStore) Close() error {
+	s.consumer.Close()
+	s.otLog.Close()
+	return nil
+}
@@ -0,0 +1,107 @@
+package ot
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// binaryVersion is the version of the binary encoding of ops, stored as its
+// first byte.
+const binaryVersion = 1
+
+// Kinds of subops in the binary encoding, stored in the low bits of the
+// length.
+const (
+	kindRetain = iota
+	kindInsert
+	kindDelete
+	kindBits = 2
+)
+
+// MarshalBinary encodes op as a version byte and the number of subops as a
+// uvarint, followed by every subop as a uvarint holding its length and kind
+// and, for inserts and deletes, the bytes of its text.
+func (op Op) MarshalBinary() ([]byte, error) {
+	return op.AppendBinary(nil)
+}
+
+// AppendBinary appends the binary encoding of op to buf.
+func (op Op) AppendBinary(buf []byte) ([]byte, error) {
+	buf = append(buf, binaryVersion)
+	buf = binary.AppendUvarint(buf, uint64(len(op)))
+	for _, sop := range op {
+		n, kind := sop.N, kindRetain
+		switch {
+		case sop.IsDelete():
+			n, kind = -n, kindDelete
+		case sop.IsInsert():
+			kind = kindInsert
+		}
+		if kind != kindRetain && len(sop.S) != n {
+			return nil, errors.New("subop length does not match its text")
+		}
+		buf = binary.AppendUvarint(buf, uint64(n)<<kindBits|uint64(kind))
+		buf = append(buf, sop.S...)
+	}
+	return buf, nil
+}
+
+func (op *Op) UnmarshalBinary(buf []byte) error {
+	n, err := op.DecodeBinary(buf)
+	if err != nil {
+		return err
+	}
+	if n != len(buf) {
+		return errors.New("trailing data after op")
+	}
+	return nil
+}
+
+// DecodeBinary decodes an op from the start of buf and returns the number of
+// bytes read.
+func (op *Op) DecodeBinary(buf []byte) (int, error) {
+	if len(buf) == 0 {
+		return 0, errors.New("empty op encoding")
+	}
+	if buf[0] != binaryVersion {
+		return 0, errors.New("unknown op encoding version")
+	}
+	i := 1
+	cnt, l := binary.Uvarint(buf[i:])
+	// every subop takes at least one byte
+	if l <= 0 || cnt > uint64(len(buf)) {
+		return 0, errors.New("invalid number of subops")
+	}
+	i += l
+
+	ret := make(Op, 0, cnt)
+	for ; cnt > 0; cnt-- {
+		v, l := binary.Uvarint(buf[i:])
+		if l <= 0 {
+			return 0, errors.New("invalid subop")
+		}
+		i += l
+		n, kind := v>>kindBits, v&(1<<kindBits-1)
+		if n > uint64(^uint(0)>>1) {
+			return 0, errors.New("subop length out of range")
+		}
+		sop := SubOp{N: int(n)}
+		switch kind {
+		case kindRetain:
+		case kindInsert, kindDelete:
+			if sop.N > len(buf)-i {
+				return 0, errors.New("subop text out of bounds")
+			}
+			sop.S = string(buf[i : i+sop.N])
+			i += sop.N
+			if kind == kindDelete {
+				sop.N = -sop.N
+			}
+		default:
+			return 0, errors.New("unknown subop kind")
+		}
+		ret = append(ret, sop)
+	}
+	*op = ret
+	return i, nil
+}
@@ -0,0 +1,43 @@
+package ot
+
+import (
+	"testing"
+)
+
+func TestBinary(t *testing.T) {
+	op := Op{}.Retain(3).Delete("€uro").Insert("EUR").Retain(1 << 16)
+	buf, err := op.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// version, count, retain, delete and its text, insert and its text,
+	// three byte retain
+	if len(buf) != 1+1+1+1+6+1+3+3 {
+		t.Errorf("unexpected encoding %x", buf)
+	}
+	var dec Op
+	err = dec.UnmarshalBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dec.Equals(op) {
+		t.Error("got", dec)
+	}
+
+	for _, bad := range [][]byte{
+		nil,
+		{2, 0},
+		buf[:len(buf)-1],
+		buf[:5],
+		append(buf[:len(buf):len(buf)], 0),
+		{1, 1, 3},
+	} {
+		if err := dec.UnmarshalBinary(bad); err == nil {
+			t.Errorf("decoded %x", bad)
+		}
+	}
+
+	if _, err := (Op{{N: 2, S: "x"}}).MarshalBinary(); err == nil {
+		t.Error("encoded insert with mismatched length")
+	}
+}
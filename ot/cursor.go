@@ -0,0 +1,47 @@
+package ot
+
+// Cursor is a position in a document.
+type Cursor int
+
+// Transform shifts the cursor through op. Text inserted at the position of
+// the cursor ends up before it, just like Transform places the inserts of
+// its first argument before those of the second.
+func (c Cursor) Transform(op Op) Cursor {
+	p := int(c)
+	np := p
+	i := 0
+	for _, sop := range op {
+		switch {
+		case sop.IsRetain():
+			i += sop.N
+		case sop.IsInsert():
+			np += sop.N
+		case sop.IsDelete():
+			n := -sop.N
+			if p-i < n {
+				n = p - i
+			}
+			np -= n
+			i += -sop.N
+		}
+		if i > p {
+			break
+		}
+	}
+	return Cursor(np)
+}
+
+// Selection is the range between Anchor and Head. A plain cursor has
+// Anchor == Head.
+type Selection struct {
+	Anchor Cursor
+	Head   Cursor
+}
+
+func (s Selection) IsCursor() bool {
+	return s.Anchor == s.Head
+}
+
+func (s Selection) Transform(op Op) Selection {
+	return Selection{s.Anchor.Transform(op), s.Head.Transform(op)}
+}
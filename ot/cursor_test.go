@@ -0,0 +1,20 @@
+package ot
+
+import (
+	"testing"
+)
+
+func TestCursor(t *testing.T) {
+	op := Op{}.Retain(2).Insert("ab").Delete("cde").Retain(3)
+	want := []Cursor{0, 1, 4, 4, 4, 4, 5, 6, 7}
+	for p, w := range want {
+		if c := Cursor(p).Transform(op); c != w {
+			t.Errorf("cursor %d: got %d, want %d", p, c, w)
+		}
+	}
+
+	s := Selection{Anchor: 1, Head: 6}.Transform(op)
+	if s != (Selection{Anchor: 1, Head: 5}) {
+		t.Error("unexpected selection", s)
+	}
+}
@@ -0,0 +1,161 @@
+package ot
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxEdits bounds the edits myers looks for. Its memory grows with the
+// square of the edits, inputs needing more of them are diffed line by line
+// or replaced as a whole.
+const maxEdits = 1000
+
+// Diff returns an op transforming old into new. The op never splits a UTF-8
+// encoded character. It is minimal unless the inputs differ too much, in
+// which case whole lines are replaced.
+func Diff(old, new []byte) Op {
+	op, ok := diff(runes(old), runes(new))
+	if !ok {
+		op, _ = diff(lines(old), lines(new))
+	}
+	return op
+}
+
+// DiffLines is like Diff, but only ever replaces whole lines.
+func DiffLines(old, new []byte) Op {
+	op, _ := diff(lines(old), lines(new))
+	return op
+}
+
+func runes(b []byte) []string {
+	toks := make([]string, 0, len(b))
+	for len(b) > 0 {
+		_, size := utf8.DecodeRune(b)
+		toks = append(toks, string(b[:size]))
+		b = b[size:]
+	}
+	return toks
+}
+
+func lines(b []byte) []string {
+	var toks []string
+	for len(b) > 0 {
+		n := bytes.IndexByte(b, '\n') + 1
+		if n == 0 {
+			n = len(b)
+		}
+		toks = append(toks, string(b[:n]))
+		b = b[n:]
+	}
+	return toks
+}
+
+func tokLen(toks []string) int {
+	n := 0
+	for _, t := range toks {
+		n += len(t)
+	}
+	return n
+}
+
+// diff returns an op transforming a into b after stripping their common
+// prefix and suffix. If the rest needs more than maxEdits edits it is
+// replaced as a whole and ok is false.
+func diff(a, b []string) (op Op, ok bool) {
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+
+	op = op.Retain(tokLen(a[:pre]))
+	mid, ok := myers(a[pre:len(a)-suf], b[pre:len(b)-suf], maxEdits)
+	if !ok {
+		mid = Op{}.Delete(strings.Join(a[pre:len(a)-suf], "")).
+			Insert(strings.Join(b[pre:len(b)-suf], ""))
+	}
+	op = append(op, mid...)
+	op = op.Retain(tokLen(a[len(a)-suf:]))
+	return op.Squeeze(), ok
+}
+
+// myers computes a shortest edit script from a to b using Myers' O(ND)
+// algorithm. It gives up if the script needs more than max edits.
+func myers(a, b []string, max int) (Op, bool) {
+	n, m := len(a), len(b)
+	if n+m < max {
+		max = n + m
+	}
+	off := max + 1
+	v := make([]int, 2*max+3)
+
+	// trace[d] holds v[k] for -d-1 <= k <= d+1 before round d.
+	var trace [][]int
+	done := false
+	for d := 0; d <= max && !done; d++ {
+		w := make([]int, 2*d+3)
+		copy(w, v[off-d-1:off+d+2])
+		trace = append(trace, w)
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				done = true
+				break
+			}
+		}
+	}
+	if !done {
+		return nil, false
+	}
+
+	// walk back from the end, collecting the edits in reverse
+	var rev Op
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		w := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && w[k-1+d+1] < w[k+1+d+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := w[prevK+d+1]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			rev = rev.Retain(len(a[x]))
+		}
+		if d > 0 {
+			if x == prevX {
+				rev = rev.Insert(b[prevY])
+			} else {
+				rev = rev.Delete(a[prevX])
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	op := make(Op, len(rev))
+	for i, sop := range rev {
+		op[len(rev)-1-i] = sop
+	}
+	return op, true
+}
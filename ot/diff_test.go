@@ -0,0 +1,83 @@
+package ot
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	cases := []struct{ old, new string }{
+		{"", ""},
+		{"", "abc"},
+		{"abc", ""},
+		{"Hello World!", "Hello wide World!"},
+		{"ABCABBA", "CBABAC"},
+		{"a€b", "a😀b"},
+		{"one\ntwo\nthree\n", "one\n2\nthree\nfour"},
+	}
+	for _, c := range cases {
+		for _, diff := range []func(old, new []byte) Op{Diff, DiffLines} {
+			op := diff([]byte(c.old), []byte(c.new))
+			if !op.Equals(op.Squeeze()) {
+				t.Errorf("%q -> %q: op not squeezed: %v", c.old, c.new, op)
+			}
+			res, err := op.ApplyTo([]byte(c.old))
+			if err != nil {
+				t.Errorf("%q -> %q: %v", c.old, c.new, err)
+				continue
+			}
+			if string(res) != c.new {
+				t.Errorf("%q -> %q: got %q", c.old, c.new, res)
+			}
+		}
+	}
+
+	op := DiffLines([]byte("one\ntwo\nthree\n"), []byte("one\ntwo!\nthree\n"))
+	want := Op{}.Retain(4).Insert("two!\n").Delete("two\n").Retain(6)
+	if !op.Equals(want) {
+		t.Error("unexpected line diff", op)
+	}
+
+	// the shortest edit script of the classic example has 5 edits
+	_, del, ins := Diff([]byte("ABCABBA"), []byte("CBABAC")).Count()
+	if del+ins != 5 {
+		t.Error("edit script not minimal", del, ins)
+	}
+}
+
+func TestDiffUnrelated(t *testing.T) {
+	// inputs without anything in common need as many edits as they have
+	// characters, far more than are searched for
+	old := make([]byte, 20000)
+	new := make([]byte, 20000)
+	for i := range old {
+		old[i] = 'a' + byte(i%13)
+		new[i] = 'n' + byte(i%11)
+		if i%80 == 79 {
+			old[i] = '\n'
+		}
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	op := Diff(old, new)
+	runtime.ReadMemStats(&after)
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 64<<20 {
+		t.Errorf("diff allocated %d bytes", alloc)
+	}
+
+	res, err := op.ApplyTo(append([]byte(nil), old...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res) != string(new) {
+		t.Error("diff of unrelated inputs does not produce the new input")
+	}
+
+	// a small change to a large input is still found
+	changed := append([]byte("x"), new...)
+	_, del, ins := Diff(new, changed).Count()
+	if del != 0 || ins != 1 {
+		t.Error("edit script not minimal", del, ins)
+	}
+}
@@ -5,9 +5,21 @@ import (
 )
 
 type Doc struct {
+	// Limits bounds the ops applied to the document.
+	Limits Limits
+
 	content []byte
 	userIxs map[uint64]int
 	hist    []Op
+	seqs    SeqTable
+}
+
+func NewDoc(content []byte) *Doc {
+	return &Doc{
+		content: content,
+		userIxs: make(map[uint64]int),
+		seqs:    make(SeqTable),
+	}
 }
 
 func (d *Doc) Apply(uid uint64, ix int, op Op) (optr Op, err error) {
@@ -15,21 +27,73 @@ func (d *Doc) Apply(uid uint64, ix int, op Op) (optr Op, err error) {
 	if !ok {
 		minIx = -1
 	}
-	if ix < minIx {
+	if ix <= minIx {
 		err = errors.New("Reference for op below user minimum")
 		return
 	}
+	if ix > len(d.hist) {
+		err = errors.New("Reference for op above history")
+		return
+	}
 
 	optr = op.Squeeze()
+	err = optr.Validate(d.lenAt(ix))
+	if err != nil {
+		return
+	}
 	for i := ix; i < len(d.hist); i++ {
 		_, optr, err = Transform(d.hist[i], optr)
 		if err != nil {
 			return
 		}
 	}
+	err = d.Limits.Check(optr, len(d.content))
+	if err != nil {
+		return
+	}
+	content, err := optr.ApplyTo(d.content)
+	if err != nil {
+		return
+	}
+	d.content = content
 	d.hist = append(d.hist, optr)
 
 	d.userIxs[uid] = len(d.hist) - 1
 
 	return
 }
+
+// lenAt returns the length of the document at revision ix.
+func (d *Doc) lenAt(ix int) int {
+	n := len(d.content)
+	for _, op := range d.hist[ix:] {
+		_, del, ins := op.Count()
+		n += del - ins
+	}
+	return n
+}
+
+// ApplySeq is Apply for an op its client numbered seq. An op which has been
+// applied before is not applied again, dup is set and optr is the op as it
+// was stored.
+func (d *Doc) ApplySeq(uid, seq uint64, ix int, op Op) (optr Op, dup bool, err error) {
+	if i, ok := d.seqs.Lookup(uid, seq); ok {
+		return d.hist[i], true, nil
+	}
+	optr, err = d.Apply(uid, ix, op)
+	if err != nil {
+		return
+	}
+	d.seqs.Add(uid, seq, int64(len(d.hist)-1))
+	return
+}
+
+// Bytes returns a copy of the current content of the document.
+func (d *Doc) Bytes() []byte {
+	return append([]byte(nil), d.content...)
+}
+
+// Rev returns the number of ops applied to the document.
+func (d *Doc) Rev() int {
+	return len(d.hist)
+}
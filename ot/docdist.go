@@ -1,11 +1,20 @@
 package ot
 
-import ()
+import (
+	"errors"
+)
 
+// DocDist is a document for clients which do not wait for their ops to be
+// acknowledged. Every op is based on the ops the client has received from
+// the server so far plus all of its own ops sent since.
 type DocDist struct {
+	// Limits bounds the ops applied to the document.
+	Limits Limits
+
 	content  []byte
 	userInfo map[uint64]UserInfo
 	hist     []userOp
+	seqs     SeqTable
 }
 
 type userOp struct {
@@ -13,92 +22,121 @@ type userOp struct {
 	op  Op
 }
 
+// UserInfo holds the ops a user has sent but not yet received back, based
+// on the first baseIx ops of the history.
 type UserInfo struct {
-	maxIx  int
-	lastIx int
+	baseIx int
 	ops    []Op
 }
 
+func NewDocDist(content []byte) *DocDist {
+	return &DocDist{
+		content:  content,
+		userInfo: make(map[uint64]UserInfo),
+		seqs:     make(SeqTable),
+	}
+}
+
 func (d *DocDist) Apply(uid uint64, ix int, op Op) (optr Op, err error) {
+	err = op.wellFormed()
+	if err != nil {
+		return
+	}
 	op = op.Squeeze()
 
 	info, ok := d.userInfo[uid]
 	if !ok {
-		info = UserInfo{maxIx: ix, lastIx: -1}
+		info = UserInfo{baseIx: ix}
+	}
+	if ix < info.baseIx {
+		err = errors.New("Reference for op below user minimum")
+		return
+	}
+	if ix > len(d.hist) {
+		err = errors.New("Reference for op above history")
+		return
 	}
 
-	var ops []Op
-	if ix >= info.maxIx {
-		info.lastIx = ix
-		info.ops = info.ops[:0]
-		info.ops = append(info.ops, op)
-
-	} else {
-		info.ops, err = moveUserOps(d.hist, info.ops, info.lastIx, ix, uid)
-		if err != nil {
-			return
-		}
-		info.ops = append(info.ops, op)
-
-		ops = make([]Op, len(info.ops))
-		copy(ops, info.ops)
-
-		ops, err = moveUserOps(d.hist, ops, ix, info.maxIx, uid)
-		if err != nil {
-			return
-		}
-
-		optr = ops[0]
+	info.ops, err = moveUserOps(d.hist, info.ops, info.baseIx, ix, uid)
+	if err != nil {
+		return
+	}
+	info.baseIx = ix
+	info.ops = append(info.ops, op)
+
+	ops := make([]Op, len(info.ops))
+	copy(ops, info.ops)
+	ops, err = moveUserOps(d.hist, ops, ix, len(d.hist), uid)
+	if err != nil {
+		return
 	}
+	if len(ops) != 1 {
+		err = errors.New("Ops of user missing from history")
+		return
+	}
+	optr = ops[0]
 
-	for i := ix; i < len(d.hist); i++ {
-		_, optr, err = Transform(d.hist[i].op, optr)
-		if err != nil {
-			return
-		}
+	err = d.Limits.Check(optr, len(d.content))
+	if err != nil {
+		return
 	}
+	content, err := optr.ApplyTo(d.content)
+	if err != nil {
+		return
+	}
+	d.content = content
 	d.hist = append(d.hist, userOp{uid: uid, op: optr})
-
-	info.maxIx = len(d.hist) - 1
-
 	d.userInfo[uid] = info
 
 	return
 }
 
+// ApplySeq is Apply for an op its client numbered seq. An op which has been
+// applied before is not applied again, dup is set and optr is the op as it
+// was stored.
+func (d *DocDist) ApplySeq(uid, seq uint64, ix int, op Op) (optr Op, dup bool, err error) {
+	if i, ok := d.seqs.Lookup(uid, seq); ok {
+		return d.hist[i].op, true, nil
+	}
+	optr, err = d.Apply(uid, ix, op)
+	if err != nil {
+		return
+	}
+	d.seqs.Add(uid, seq, int64(len(d.hist)-1))
+	return
+}
+
+// Bytes returns the current content of the document.
+func (d *DocDist) Bytes() []byte {
+	return d.content
+}
+
+// Rev returns the number of ops applied to the document.
+func (d *DocDist) Rev() int {
+	return len(d.hist)
+}
+
+// moveUserOps rebases the pending ops of user uid from the first from ops of
+// the history to the first to ops. An op of the user in the history is the
+// first pending op in its transformed form and drops out, ops of other users
+// are transformed past the pending ops.
 func moveUserOps(hist []userOp, ops []Op, from, to int, uid uint64) ([]Op, error) {
-	var comb Op
 	var err error
-	for i := from + 1; i <= to; i++ {
+	for i := from; i < to; i++ {
 		if hist[i].uid == uid {
-			for j := 0; j < len(ops)-1; j++ {
-				comb, _, err = Transform(comb, ops[j])
-				if err != nil {
-					return nil, err
-				}
-				_, ops[j], err = Transform(comb, ops[j+1])
-				if err != nil {
-					return nil, err
-				}
+			if len(ops) == 0 {
+				return nil, errors.New("Unexpected op of user in history")
 			}
-			ops = ops[:len(ops)-1]
-			comb = Op{}
-		} else {
-			comb, err = Compose(comb, hist[i].op)
+			ops = ops[1:]
+			continue
+		}
+		other := hist[i].op
+		for j := range ops {
+			other, ops[j], err = Transform(other, ops[j])
 			if err != nil {
 				return nil, err
 			}
 		}
 	}
-	for j := range ops {
-		_, ops[j], err = Transform(comb, ops[j])
-		if err != nil {
-			return nil, err
-		}
-		comb, _, err = Transform(comb, ops[j])
-		if err != nil {
-			return nil, err
-		}
-	}
 	return ops, nil
 }
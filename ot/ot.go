@@ -2,7 +2,6 @@ package ot
 
 import (
 	"errors"
-	"fmt"
 )
 
 type SubOp struct {
@@ -90,6 +89,10 @@ func (op Op) Squeeze() Op {
 		case lastOp.IsInsert() && sop.IsInsert():
 			ret[i].N += sop.N
 			ret[i].S += sop.S
+		case lastOp.IsDelete() && sop.IsInsert() && i > 0 && ret[i-1].IsInsert():
+			// merged with the insert before the delete
+			ret[i-1].N += sop.N
+			ret[i-1].S += sop.S
 		case lastOp.IsDelete() && sop.IsInsert():
 			//insert always before delete
 			ret[i] = sop
@@ -130,6 +133,12 @@ func Compose(a, b Op) (Op, error) {
 
 	var ab Op
 
+	if err := a.wellFormed(); err != nil {
+		return nil, err
+	}
+	if err := b.wellFormed(); err != nil {
+		return nil, err
+	}
 	a = a.Squeeze()
 	b = b.Squeeze()
 
@@ -147,7 +156,7 @@ func Compose(a, b Op) (Op, error) {
 
 	for {
 		if opa.IsNoop() && opb.IsNoop() {
-			return ab, nil
+			return ab.Squeeze(), nil
 		}
 
 		if opa.IsDelete() {
@@ -178,6 +187,7 @@ func Compose(a, b Op) (Op, error) {
 				opb, ib = subop(b, ib)
 			case opa.N < opb.N:
 				ab = append(ab, opa)
+				opb.N -= opa.N
 
 				opa, ia = subop(a, ia)
 			}
@@ -236,17 +246,34 @@ func Compose(a, b Op) (Op, error) {
 				opa, ia = subop(a, ia)
 			}
 		default:
-			panic("unreachable")
+			return nil, errors.New("Compose got ops of mismatching length")
 		}
-
 	}
-	ab = ab.Squeeze()
-	return ab, nil
 }
 
+// Transform transforms two ops based on the same document against each
+// other, so at can be applied after b and bt after a.
 func Transform(a, b Op) (at Op, bt Op, err error) {
-	if len(a) == 0 || len(b) == 0 {
-		return a, b, nil
+	if err = a.wellFormed(); err != nil {
+		return nil, nil, err
+	}
+	if err = b.wellFormed(); err != nil {
+		return nil, nil, err
+	}
+	// an empty op leaves the document unchanged
+	if len(a) == 0 {
+		ret, _, ins := b.Count()
+		return Op{}.Retain(ret + ins).Squeeze(), b, nil
+	}
+	if len(b) == 0 {
+		ret, _, ins := a.Count()
+		return a, Op{}.Retain(ret + ins).Squeeze(), nil
+	}
+
+	reta, dela, _ := a.Count()
+	retb, delb, _ := b.Count()
+	if reta+dela != retb+delb {
+		return nil, nil, errors.New("Transform requires ops based on the same document")
 	}
 
 	ia, ib := 0, 0
@@ -257,7 +284,6 @@ func Transform(a, b Op) (at Op, bt Op, err error) {
 	opb, ib := subop(b, ib)
 
 	for {
-		fmt.Println(opa, opb)
 		if opa.IsNoop() && opb.IsNoop() {
 			return
 		}
@@ -354,22 +380,24 @@ func Transform(a, b Op) (at Op, bt Op, err error) {
 				opb, ib = subop(b, ib)
 			}
 		default:
-			panic("unreachable")
+			return nil, nil, errors.New("Transform got ops of mismatching length")
 		}
 	}
 }
 
+// ApplyTo applies op to doc, which may be modified in place. Invalid ops
+// are rejected before doc is touched.
 func (op Op) ApplyTo(doc []byte) ([]byte, error) {
+	err := op.ValidateFor(doc)
+	if err != nil {
+		return nil, err
+	}
 	ret, del, ins := op.Count()
 
 	baseLength := ret + del
 	targetLength := ret + ins
 	workspace := ret + del + ins
 
-	if baseLength != len(doc) {
-		return nil, errors.New("The operation's base length must be equal to the documents length.")
-	}
-
 	if cap(doc) < workspace {
 		tmp := make([]byte, workspace*3/2)
 		copy(tmp, doc)
@@ -378,18 +406,19 @@ func (op Op) ApplyTo(doc []byte) ([]byte, error) {
 	doc = doc[:workspace]
 
 	docIx := 0
+	docLen := baseLength
 	for _, sop := range op {
 		switch {
 		case sop.IsRetain():
 			docIx += sop.N
 		case sop.IsInsert():
-			copy(doc[docIx+sop.N:], doc[docIx:])
+			copy(doc[docIx+sop.N:], doc[docIx:docLen])
 			copy(doc[docIx:], []byte(sop.S))
+			docIx += sop.N
+			docLen += sop.N
 		case sop.IsDelete():
-			if sop.S != string(doc[docIx:docIx-sop.N]) {
-				return nil, errors.New("The string which should be deleted does not match the document.")
-			}
-			copy(doc[docIx:], doc[docIx-sop.N:])
+			copy(doc[docIx:], doc[docIx-sop.N:docLen])
+			docLen += sop.N
 		}
 	}
 	doc = doc[:targetLength]
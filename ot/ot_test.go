@@ -1,7 +1,6 @@
 package ot
 
 import (
-	"fmt"
 	"testing"
 )
 
@@ -11,8 +10,6 @@ func TestOT(t *testing.T) {
 	op1 := Op{{N: 6}, {N: 5, S: "wide "}, {N: 6}}
 	op2 := Op{{N: len(b)}, {N: 10, S: " and stuff"}}
 
-	fmt.Println(string(b))
-
 	b2 := make([]byte, len(b))
 	copy(b2, b)
 
@@ -21,14 +18,17 @@ func TestOT(t *testing.T) {
 		t.Error(err)
 	}
 
-	fmt.Println(string(b))
+	if string(b) != "Hello wide World!" {
+		t.Errorf("op1 gave %q", b)
+	}
 
 	b2, err = op2.ApplyTo(b2)
 	if err != nil {
 		t.Error(err)
 	}
-
-	fmt.Println(string(b2))
+	if string(b2) != "Hello World! and stuff" {
+		t.Errorf("op2 gave %q", b2)
+	}
 
 	op1t, op2t, err := Transform(op1, op2)
 	if err != nil {
@@ -39,13 +39,14 @@ func TestOT(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	fmt.Println(string(b))
 
 	b2, err = op1t.ApplyTo(b2)
 	if err != nil {
 		t.Error(err)
 	}
-	fmt.Println(string(b2))
+	if string(b) != "Hello wide World! and stuff" || string(b) != string(b2) {
+		t.Errorf("transformed ops gave %q and %q", b, b2)
+	}
 
 	op1inv := op1.Inverse()
 	op1inv, _, err = Transform(op1inv, op2t)
@@ -58,16 +59,37 @@ func TestOT(t *testing.T) {
 		t.Error(err)
 	}
 
+	// with op1 undone the document is back at the state after op2, so the
+	// inverse of op2 applies as is
 	op2inv := op2.Inverse()
-	op2inv, _, err = Transform(op2inv, op1inv)
-	if err != nil {
-		t.Error(err)
-	}
 
 	b, err = op2inv.ApplyTo(b)
 	if err != nil {
 		t.Error(err)
 	}
 
-	fmt.Println(string(b))
+	if string(b) != "Hello World!" {
+		t.Errorf("undoing both ops gave %q", b)
+	}
+}
+
+func TestSqueeze(t *testing.T) {
+	tests := []struct {
+		op, want Op
+	}{
+		{Op{}.Retain(2).Retain(3).Delete("a").Delete("b"), Op{}.Retain(5).Delete("ab")},
+		{Op{}.Delete("b").Insert("a"), Op{}.Insert("a").Delete("b")},
+		// an insert after a delete joins the insert before it
+		{Op{}.Insert("a").Delete("b").Insert("c"), Op{}.Insert("ac").Delete("b")},
+		{Op{}.Insert("a").Delete("b").Insert("c").Delete("d").Insert("e").Retain(1), Op{}.Insert("ace").Delete("bd").Retain(1)},
+	}
+	for _, test := range tests {
+		s := test.op.Squeeze()
+		if !s.Equals(test.want) {
+			t.Errorf("%v squeezed to %v, want %v", test.op, s, test.want)
+		}
+		if !s.Squeeze().Equals(s) {
+			t.Errorf("%v squeezed again to %v", s, s.Squeeze())
+		}
+	}
 }
@@ -0,0 +1,289 @@
+package ot
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"unicode/utf8"
+)
+
+// The property tests generate documents and ops from a sequence of choice
+// bytes. Any byte sequence describes a valid case, so a failing case is
+// shrunk by shortening and lowering its choices, and native fuzzing can
+// mutate the choices directly.
+
+type choices struct {
+	b []byte
+	i int
+}
+
+// next returns a number in [0, n).
+func (c *choices) next(n int) int {
+	if c.i >= len(c.b) || n <= 1 {
+		c.i++
+		return 0
+	}
+	v := int(c.b[c.i]) % n
+	c.i++
+	return v
+}
+
+var alphabet = []string{"a", "b", "c", "\n", "€", "😀"}
+
+func (c *choices) text(max int) string {
+	s := ""
+	for n := c.next(max + 1); n > 0; n-- {
+		s += alphabet[c.next(len(alphabet))]
+	}
+	return s
+}
+
+func (c *choices) doc() []byte {
+	return []byte(c.text(12))
+}
+
+// op returns a random op based on doc which never splits a character.
+func (c *choices) op(doc []byte) Op {
+	var op Op
+	for len(doc) > 0 {
+		n := 1 + c.next(4)
+		size := 0
+		for ; n > 0 && size < len(doc); n-- {
+			_, s := utf8.DecodeRune(doc[size:])
+			size += s
+		}
+		switch c.next(4) {
+		case 0:
+			op = op.Retain(size)
+		case 1:
+			op = op.Delete(string(doc[:size]))
+		case 2:
+			op = op.Insert(c.text(3)).Retain(size)
+		case 3:
+			op = op.Insert(c.text(3)).Delete(string(doc[:size]))
+		}
+		doc = doc[size:]
+	}
+	if c.next(2) == 1 {
+		op = op.Insert(c.text(3))
+	}
+	return op
+}
+
+func apply(op Op, doc []byte) ([]byte, error) {
+	buf := make([]byte, len(doc))
+	copy(buf, doc)
+	return op.ApplyTo(buf)
+}
+
+type property func(c *choices) error
+
+// run evaluates the property, turning panics into errors.
+func (p property) run(b []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return p(&choices{b: b})
+}
+
+// shrink looks for a shorter or smaller choice sequence still failing p.
+func (p property) shrink(b []byte) []byte {
+	for improved := true; improved; {
+		improved = false
+		for size := len(b) / 2; size > 0; size /= 2 {
+			for i := 0; i+size <= len(b); {
+				cand := append(append([]byte{}, b[:i]...), b[i+size:]...)
+				if p.run(cand) != nil {
+					b = cand
+					improved = true
+				} else {
+					i++
+				}
+			}
+		}
+		for i := range b {
+			for _, v := range []byte{0, b[i] / 2, b[i] - 1} {
+				if v >= b[i] {
+					continue
+				}
+				cand := append([]byte{}, b...)
+				cand[i] = v
+				if p.run(cand) != nil {
+					b = cand
+					improved = true
+					break
+				}
+			}
+		}
+	}
+	return b
+}
+
+// check runs p on random choice sequences and reports the smallest failing
+// case found.
+func check(t *testing.T, p property) {
+	r := rand.New(rand.NewSource(1))
+	n := 2000
+	if testing.Short() {
+		n = 200
+	}
+	for i := 0; i < n; i++ {
+		b := make([]byte, 64)
+		r.Read(b)
+		if p.run(b) != nil {
+			b = p.shrink(b)
+			t.Fatalf("%v\nchoices: %q", p.run(b), b)
+		}
+	}
+}
+
+func propTP1(c *choices) error {
+	doc := c.doc()
+	a := c.op(doc)
+	b := c.op(doc)
+	at, bt, err := Transform(a, b)
+	if err != nil {
+		return fmt.Errorf("doc %q, a %v, b %v: %v", doc, a, b, err)
+	}
+	da, err := apply(a, doc)
+	if err == nil {
+		da, err = apply(bt, da)
+	}
+	if err != nil {
+		return fmt.Errorf("doc %q, a %v, b %v, bt %v: %v", doc, a, b, bt, err)
+	}
+	db, err := apply(b, doc)
+	if err == nil {
+		db, err = apply(at, db)
+	}
+	if err != nil {
+		return fmt.Errorf("doc %q, a %v, b %v, at %v: %v", doc, a, b, at, err)
+	}
+	if string(da) != string(db) {
+		return fmt.Errorf("doc %q, a %v, b %v: diverged to %q and %q", doc, a, b, da, db)
+	}
+	return nil
+}
+
+func propCompose(c *choices) error {
+	doc := c.doc()
+	a := c.op(doc)
+	da, err := apply(a, doc)
+	if err != nil {
+		return err
+	}
+	b := c.op(da)
+	db, err := apply(b, da)
+	if err != nil {
+		return err
+	}
+	cop := c.op(db)
+	dc, err := apply(cop, db)
+	if err != nil {
+		return err
+	}
+
+	ab, err := Compose(a, b)
+	if err != nil {
+		return fmt.Errorf("doc %q, a %v, b %v: %v", doc, a, b, err)
+	}
+	res, err := apply(ab, doc)
+	if err != nil || string(res) != string(db) {
+		return fmt.Errorf("doc %q, a %v, b %v, ab %v: got %q, %v, want %q", doc, a, b, ab, res, err, db)
+	}
+
+	bc, err := Compose(b, cop)
+	if err != nil {
+		return fmt.Errorf("doc %q, b %v, c %v: %v", da, b, cop, err)
+	}
+	left, err := Compose(ab, cop)
+	if err != nil {
+		return fmt.Errorf("doc %q, ab %v, c %v: %v", doc, ab, cop, err)
+	}
+	right, err := Compose(a, bc)
+	if err != nil {
+		return fmt.Errorf("doc %q, a %v, bc %v: %v", doc, a, bc, err)
+	}
+	if !left.Squeeze().Equals(right.Squeeze()) {
+		return fmt.Errorf("doc %q, a %v, b %v, c %v: (ab)c %v != a(bc) %v", doc, a, b, cop, left, right)
+	}
+	res, err = apply(left, doc)
+	if err != nil || string(res) != string(dc) {
+		return fmt.Errorf("doc %q, a %v, b %v, c %v: got %q, %v, want %q", doc, a, b, cop, res, err, dc)
+	}
+	return nil
+}
+
+func propInverse(c *choices) error {
+	doc := c.doc()
+	a := c.op(doc)
+	da, err := apply(a, doc)
+	if err != nil {
+		return err
+	}
+	res, err := apply(a.Inverse(), da)
+	if err != nil || string(res) != string(doc) {
+		return fmt.Errorf("doc %q, a %v: inverse gave %q, %v", doc, a, res, err)
+	}
+	return nil
+}
+
+func propSqueeze(c *choices) error {
+	doc := c.doc()
+	a := c.op(doc)
+	s := a.Squeeze()
+	if !s.Squeeze().Equals(s) {
+		return fmt.Errorf("a %v: squeezing %v again gave %v", a, s, s.Squeeze())
+	}
+	da, err := apply(a, doc)
+	if err != nil {
+		return err
+	}
+	ds, err := apply(s, doc)
+	if err != nil || string(ds) != string(da) {
+		return fmt.Errorf("doc %q, a %v: squeezed op gave %q, %v, want %q", doc, a, ds, err, da)
+	}
+	return nil
+}
+
+func propBinary(c *choices) error {
+	a := c.op(c.doc())
+	buf, err := a.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	var b Op
+	err = b.UnmarshalBinary(buf)
+	if err != nil || !b.Equals(a) {
+		return fmt.Errorf("a %v: decoding %x gave %v, %v", a, buf, b, err)
+	}
+	return nil
+}
+
+var properties = map[string]property{
+	"TP1":     propTP1,
+	"Compose": propCompose,
+	"Inverse": propInverse,
+	"Squeeze": propSqueeze,
+	"Binary":  propBinary,
+}
+
+func TestProperties(t *testing.T) {
+	for name, p := range properties {
+		t.Run(name, func(t *testing.T) { check(t, p) })
+	}
+}
+
+func FuzzProperties(f *testing.F) {
+	f.Add([]byte("seed"))
+	f.Add([]byte{5, 0, 1, 2, 3, 4, 5, 1, 2, 1, 0, 2, 1, 1, 2, 0, 1, 2})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		for name, p := range properties {
+			if err := p.run(b); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,52 @@
+package ot
+
+// SeqWindow is the number of sequence numbers a SeqTable remembers for
+// every user.
+const SeqWindow = 64
+
+// SeqEntry records the history index Ix an op numbered Seq was stored at.
+type SeqEntry struct {
+	Seq uint64
+	Ix  int64
+}
+
+// SeqTable remembers the sequence numbers clients assigned to their latest
+// ops, keyed by user, so ops sent again after a timeout are recognized
+// instead of being applied twice. Sequence numbers have to be unique among
+// the latest SeqWindow ops of a user. 0 means an op is not numbered.
+type SeqTable map[uint64][]SeqEntry
+
+// Lookup returns the history index the op numbered seq by uid was stored at.
+func (t SeqTable) Lookup(uid, seq uint64) (ix int64, ok bool) {
+	if seq == 0 {
+		return 0, false
+	}
+	for _, e := range t[uid] {
+		if e.Seq == seq {
+			return e.Ix, true
+		}
+	}
+	return 0, false
+}
+
+// Add records that the op numbered seq by uid was stored at history index
+// ix, forgetting the oldest entry of uid beyond SeqWindow.
+func (t SeqTable) Add(uid, seq uint64, ix int64) {
+	if seq == 0 {
+		return
+	}
+	entries := append(t[uid], SeqEntry{Seq: seq, Ix: ix})
+	if len(entries) > SeqWindow {
+		entries = append(entries[:0:0], entries[len(entries)-SeqWindow:]...)
+	}
+	t[uid] = entries
+}
+
+// Clone returns a copy of t which is not affected by later changes to t.
+func (t SeqTable) Clone() SeqTable {
+	c := make(SeqTable, len(t))
+	for uid, entries := range t {
+		c[uid] = append([]SeqEntry(nil), entries...)
+	}
+	return c
+}
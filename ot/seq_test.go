@@ -0,0 +1,72 @@
+package ot
+
+import (
+	"testing"
+)
+
+type seqApplier interface {
+	ApplySeq(uid, seq uint64, ix int, op Op) (Op, bool, error)
+	Bytes() []byte
+	Rev() int
+}
+
+func TestApplySeq(t *testing.T) {
+	testApplySeq(t, NewDoc([]byte("Hello World!")))
+	testApplySeq(t, NewDocDist([]byte("Hello World!")))
+}
+
+func testApplySeq(t *testing.T, d seqApplier) {
+	op := Op{}.Retain(6).Insert("wide ").Retain(6)
+	optr, dup, err := d.ApplySeq(1, 7, 0, op)
+	if err != nil || dup {
+		t.Fatal(dup, err)
+	}
+	_, _, err = d.ApplySeq(2, 7, 0, Op{}.Delete("Hello").Retain(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sent again after a timeout
+	again, dup, err := d.ApplySeq(1, 7, 0, op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dup || !again.Equals(optr) || d.Rev() != 2 {
+		t.Errorf("op applied again: %v at revision %d", again, d.Rev())
+	}
+	if string(d.Bytes()) != " wide World!" {
+		t.Errorf("got %q", d.Bytes())
+	}
+
+	// unnumbered ops are never duplicates
+	_, _, err = d.ApplySeq(1, 0, 2, Op{}.Retain(12).Insert("!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, dup, err = d.ApplySeq(1, 0, 3, Op{}.Retain(13).Insert("!"))
+	if err != nil || dup {
+		t.Fatal(dup, err)
+	}
+}
+
+func TestSeqTable(t *testing.T) {
+	tab := make(SeqTable)
+	for i := 1; i <= SeqWindow+1; i++ {
+		tab.Add(1, uint64(i), int64(i))
+	}
+	if _, ok := tab.Lookup(1, 1); ok {
+		t.Error("oldest entry kept beyond the window")
+	}
+	if ix, ok := tab.Lookup(1, SeqWindow+1); !ok || ix != SeqWindow+1 {
+		t.Error("latest entry missing:", ix, ok)
+	}
+	if _, ok := tab.Lookup(2, 2); ok {
+		t.Error("entry found for another user")
+	}
+
+	c := tab.Clone()
+	tab.Add(1, 100, 100)
+	if _, ok := c.Lookup(1, 100); ok {
+		t.Error("clone changed along with the table")
+	}
+}
@@ -0,0 +1,244 @@
+package ot_test
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/dane-unltd/weeded/client"
+	"github.com/dane-unltd/weeded/ot"
+)
+
+// The simulation connects virtual clients to a server document through
+// links with random latency. Messages on one link arrive in order, but
+// messages of different clients are interleaved arbitrarily.
+
+type message struct {
+	at  int
+	ix  int
+	op  ot.Op
+	ack bool
+}
+
+type link struct {
+	queue []message
+}
+
+func (l *link) send(r *rand.Rand, now int, m message) {
+	m.at = now + r.Intn(20)
+	if n := len(l.queue); n > 0 && l.queue[n-1].at > m.at {
+		m.at = l.queue[n-1].at
+	}
+	l.queue = append(l.queue, m)
+}
+
+func (l *link) ready(now int) bool {
+	return len(l.queue) > 0 && l.queue[0].at <= now
+}
+
+func (l *link) receive() message {
+	m := l.queue[0]
+	l.queue = l.queue[1:]
+	return m
+}
+
+type server interface {
+	Apply(uid uint64, ix int, op ot.Op) (ot.Op, error)
+	Bytes() []byte
+}
+
+type peer interface {
+	local(op ot.Op) (send bool, ix int, sop ot.Op, err error)
+	remote(m message) (send bool, ix int, sop ot.Op, err error)
+	bytes() []byte
+}
+
+// waitingPeer waits for each op to be acknowledged, as expected by ot.Doc.
+type waitingPeer struct {
+	c   *client.Client
+	doc []byte
+}
+
+func (p *waitingPeer) local(op ot.Op) (bool, int, ot.Op, error) {
+	var err error
+	p.doc, err = op.ApplyTo(p.doc)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	send, ix, err := p.c.Local(op)
+	return send, int(ix), op, err
+}
+
+func (p *waitingPeer) remote(m message) (bool, int, ot.Op, error) {
+	if m.ack {
+		send, ix, op, err := p.c.Ack()
+		return send, int(ix), op, err
+	}
+	op, err := p.c.Remote(m.op)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	p.doc, err = op.ApplyTo(p.doc)
+	return false, 0, nil, err
+}
+
+func (p *waitingPeer) bytes() []byte { return p.doc }
+
+// eagerPeer sends every op right away, as supported by ot.DocDist.
+type eagerPeer struct {
+	rev     int
+	pending []ot.Op
+	doc     []byte
+}
+
+func (p *eagerPeer) local(op ot.Op) (bool, int, ot.Op, error) {
+	var err error
+	p.doc, err = op.ApplyTo(p.doc)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	p.pending = append(p.pending, op)
+	return true, p.rev, op, nil
+}
+
+func (p *eagerPeer) remote(m message) (bool, int, ot.Op, error) {
+	p.rev++
+	if m.ack {
+		p.pending = p.pending[1:]
+		return false, 0, nil, nil
+	}
+	op := m.op
+	var err error
+	for i := range p.pending {
+		op, p.pending[i], err = ot.Transform(op, p.pending[i])
+		if err != nil {
+			return false, 0, nil, err
+		}
+	}
+	p.doc, err = op.ApplyTo(p.doc)
+	return false, 0, nil, err
+}
+
+func (p *eagerPeer) bytes() []byte { return p.doc }
+
+func randOp(r *rand.Rand, doc []byte) ot.Op {
+	var op ot.Op
+	for i := 0; i < len(doc); {
+		n := 1 + r.Intn(len(doc)-i)
+		if n > 5 {
+			n = 5
+		}
+		switch r.Intn(4) {
+		case 0:
+			op = op.Delete(string(doc[i : i+n]))
+		case 1:
+			op = op.Insert(randText(r))
+			fallthrough
+		default:
+			op = op.Retain(n)
+		}
+		i += n
+	}
+	if r.Intn(3) == 0 {
+		op = op.Insert(randText(r))
+	}
+	return op
+}
+
+func randText(r *rand.Rand) string {
+	b := make([]byte, 1+r.Intn(4))
+	for i := range b {
+		b[i] = "abcdefgh\n"[r.Intn(9)]
+	}
+	return string(b)
+}
+
+func simulate(seed int64, srv server, peers []peer) error {
+	r := rand.New(rand.NewSource(seed))
+	up := make([]link, len(peers))
+	down := make([]link, len(peers))
+
+	upload := func(now, i int, send bool, ix int, op ot.Op, err error) error {
+		if err != nil {
+			return fmt.Errorf("client %d: %v", i, err)
+		}
+		if send {
+			up[i].send(r, now, message{ix: ix, op: op})
+		}
+		return nil
+	}
+
+	for now := 0; ; now++ {
+		busy := false
+		if now < 300 {
+			busy = true
+			for i, p := range peers {
+				if r.Intn(8) == 0 {
+					send, ix, op, err := p.local(randOp(r, p.bytes()))
+					if err := upload(now, i, send, ix, op, err); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		for _, i := range r.Perm(len(peers)) {
+			for up[i].ready(now) {
+				m := up[i].receive()
+				optr, err := srv.Apply(uint64(i), m.ix, m.op)
+				if err != nil {
+					return fmt.Errorf("server, op of client %d: %v", i, err)
+				}
+				for j := range peers {
+					down[j].send(r, now, message{op: optr, ack: i == j})
+				}
+			}
+			for down[i].ready(now) {
+				send, ix, op, err := peers[i].remote(down[i].receive())
+				if err := upload(now, i, send, ix, op, err); err != nil {
+					return err
+				}
+			}
+			if len(up[i].queue) > 0 || len(down[i].queue) > 0 {
+				busy = true
+			}
+		}
+		if !busy {
+			break
+		}
+	}
+
+	want := string(srv.Bytes())
+	for i, p := range peers {
+		if got := string(p.bytes()); got != want {
+			return fmt.Errorf("client %d diverged: %q, server %q", i, got, want)
+		}
+	}
+	return nil
+}
+
+func TestSimulateDoc(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		start := []byte("Hello World!\n")
+		var peers []peer
+		for i := 0; i < 4; i++ {
+			peers = append(peers, &waitingPeer{c: client.New(0), doc: append([]byte{}, start...)})
+		}
+		if err := simulate(seed, ot.NewDoc(append([]byte{}, start...)), peers); err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+	}
+}
+
+func TestSimulateDocDist(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		start := []byte("Hello World!\n")
+		var peers []peer
+		for i := 0; i < 4; i++ {
+			peers = append(peers, &eagerPeer{doc: append([]byte{}, start...)})
+		}
+		if err := simulate(seed, ot.NewDocDist(append([]byte{}, start...)), peers); err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package ot
+
+import (
+	"errors"
+)
+
+// UndoManager keeps an undo and a redo stack for every user of a Doc. Undo
+// only reverts the user's own ops, concurrent ops of other users are kept.
+type UndoManager struct {
+	doc   *Doc
+	users map[uint64]*undoStacks
+}
+
+type undoStacks struct {
+	undo []int
+	redo []int
+}
+
+func NewUndoManager(d *Doc) *UndoManager {
+	return &UndoManager{
+		doc:   d,
+		users: make(map[uint64]*undoStacks),
+	}
+}
+
+func (m *UndoManager) stacks(uid uint64) *undoStacks {
+	s, ok := m.users[uid]
+	if !ok {
+		s = &undoStacks{}
+		m.users[uid] = s
+	}
+	return s
+}
+
+// Apply applies op to the document and records it on the undo stack of uid.
+// Recording a new op clears the redo stack.
+func (m *UndoManager) Apply(uid uint64, ix int, op Op) (Op, error) {
+	optr, err := m.doc.Apply(uid, ix, op)
+	if err != nil {
+		return nil, err
+	}
+	s := m.stacks(uid)
+	s.undo = append(s.undo, len(m.doc.hist)-1)
+	s.redo = s.redo[:0]
+	return optr, nil
+}
+
+// Undo applies the op reverting the last op of uid which has not been undone
+// yet and returns it as applied to the latest revision.
+func (m *UndoManager) Undo(uid uint64) (Op, error) {
+	s := m.stacks(uid)
+	if len(s.undo) == 0 {
+		return nil, errors.New("Nothing to undo")
+	}
+	optr, err := m.revert(uid, s.undo[len(s.undo)-1])
+	if err != nil {
+		return nil, err
+	}
+	s.undo = s.undo[:len(s.undo)-1]
+	s.redo = append(s.redo, len(m.doc.hist)-1)
+	return optr, nil
+}
+
+// Redo applies the op reverting the last undo of uid and returns it like
+// Undo.
+func (m *UndoManager) Redo(uid uint64) (Op, error) {
+	s := m.stacks(uid)
+	if len(s.redo) == 0 {
+		return nil, errors.New("Nothing to redo")
+	}
+	optr, err := m.revert(uid, s.redo[len(s.redo)-1])
+	if err != nil {
+		return nil, err
+	}
+	s.redo = s.redo[:len(s.redo)-1]
+	s.undo = append(s.undo, len(m.doc.hist)-1)
+	return optr, nil
+}
+
+// revert applies the inverse of the op at history index ix, transformed past
+// all later ops, for uid.
+func (m *UndoManager) revert(uid uint64, ix int) (Op, error) {
+	hist := m.doc.hist
+	inv := hist[ix].Inverse()
+	var err error
+	for i := ix + 1; i < len(hist); i++ {
+		inv, _, err = Transform(inv, hist[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m.doc.Apply(uid, len(hist), inv)
+}
@@ -0,0 +1,77 @@
+package ot
+
+import (
+	"testing"
+)
+
+func TestUndo(t *testing.T) {
+	d := NewDoc([]byte("Hello World!"))
+	m := NewUndoManager(d)
+
+	apply := func(uid uint64, ix int, op Op) {
+		if _, err := m.Apply(uid, ix, op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	revert := func(f func(uint64) (Op, error), uid uint64) error {
+		rev := d.Rev()
+		_, err := f(uid)
+		if err == nil && d.Rev() != rev+1 {
+			t.Fatalf("revision %d after reverting at %d", d.Rev(), rev)
+		}
+		return err
+	}
+	check := func(want string) {
+		if string(d.Bytes()) != want {
+			t.Fatalf("got %q, want %q", d.Bytes(), want)
+		}
+	}
+
+	apply(1, 0, Op{}.Retain(6).Insert("wide ").Retain(6))
+	apply(2, 0, Op{}.Delete("Hello").Retain(7))
+	apply(1, 2, Op{}.Retain(12).Insert(" and stuff"))
+	check(" wide World! and stuff")
+
+	if err := revert(m.Undo, 1); err != nil {
+		t.Fatal(err)
+	}
+	check(" wide World!")
+	if err := revert(m.Undo, 1); err != nil {
+		t.Fatal(err)
+	}
+	check(" World!")
+	if err := revert(m.Undo, 1); err == nil {
+		t.Fatal("undo past the first op")
+	}
+
+	if err := revert(m.Redo, 1); err != nil {
+		t.Fatal(err)
+	}
+	check(" wide World!")
+
+	if err := revert(m.Undo, 2); err != nil {
+		t.Fatal(err)
+	}
+	check("Hello wide World!")
+
+	apply(1, d.Rev(), Op{}.Retain(17).Insert("?"))
+	if err := revert(m.Redo, 1); err == nil {
+		t.Fatal("redo after new op")
+	}
+	check("Hello wide World!?")
+
+	// the content returned is a copy
+	d.Bytes()[0] = 'J'
+	check("Hello wide World!?")
+
+	// ops of other users applied since are kept
+	apply(2, d.Rev(), Op{}.Retain(18).Insert("!"))
+	if err := revert(m.Undo, 1); err != nil {
+		t.Fatal(err)
+	}
+	check("Hello wide World!!")
+	if err := revert(m.Redo, 1); err != nil {
+		t.Fatal(err)
+	}
+	check("Hello wide World!?!")
+}
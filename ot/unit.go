@@ -0,0 +1,144 @@
+package ot
+
+import (
+	"errors"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Unit selects how the counts of an op are measured. Ops are applied in
+// Bytes; clients counting in other units convert their ops with ToBytes and
+// FromBytes.
+type Unit int
+
+const (
+	Bytes Unit = iota
+	Runes
+	UTF16
+)
+
+func (u Unit) String() string {
+	switch u {
+	case Bytes:
+		return "bytes"
+	case Runes:
+		return "runes"
+	case UTF16:
+		return "utf16"
+	}
+	return "unknown"
+}
+
+// Len returns the length of s measured in u.
+func (u Unit) Len(s string) int {
+	switch u {
+	case Runes:
+		return utf8.RuneCountInString(s)
+	case UTF16:
+		n := 0
+		for _, r := range s {
+			n += runeLen16(r)
+		}
+		return n
+	}
+	return len(s)
+}
+
+func runeLen16(r rune) int {
+	if r1, _ := utf16.EncodeRune(r); r1 != utf8.RuneError {
+		return 2
+	}
+	return 1
+}
+
+// bytesFor returns the number of bytes at the start of doc spanning n units.
+func (u Unit) bytesFor(doc []byte, n int) (int, error) {
+	if u == Bytes {
+		if n > len(doc) {
+			return 0, errors.New("The operation is longer than the document.")
+		}
+		return n, nil
+	}
+	i := 0
+	for n > 0 {
+		if i >= len(doc) {
+			return 0, errors.New("The operation is longer than the document.")
+		}
+		r, size := utf8.DecodeRune(doc[i:])
+		if u == UTF16 {
+			n -= runeLen16(r)
+		} else {
+			n--
+		}
+		i += size
+	}
+	if n < 0 {
+		return 0, errors.New("The operation splits a surrogate pair.")
+	}
+	return i, nil
+}
+
+// ToBytes converts op, measured in u, to an op measured in bytes. doc is the
+// document op is based on.
+func (op Op) ToBytes(doc []byte, u Unit) (Op, error) {
+	var ret Op
+	docIx := 0
+	for _, sop := range op {
+		switch {
+		case sop.IsRetain():
+			n, err := u.bytesFor(doc[docIx:], sop.N)
+			if err != nil {
+				return nil, err
+			}
+			ret = ret.Retain(n)
+			docIx += n
+		case sop.IsInsert():
+			ret = ret.Insert(sop.S)
+		case sop.IsDelete():
+			ret = ret.Delete(sop.S)
+			docIx += len(sop.S)
+			if docIx > len(doc) {
+				return nil, errors.New("The operation is longer than the document.")
+			}
+		}
+	}
+	return ret, nil
+}
+
+// FromBytes converts op, measured in bytes, to an op measured in u. doc is
+// the document op is based on.
+func (op Op) FromBytes(doc []byte, u Unit) (Op, error) {
+	var ret Op
+	docIx := 0
+	for _, sop := range op {
+		switch {
+		case sop.IsRetain():
+			if docIx+sop.N > len(doc) {
+				return nil, errors.New("The operation is longer than the document.")
+			}
+			ret = append(ret, SubOp{N: u.Len(string(doc[docIx : docIx+sop.N]))})
+			docIx += sop.N
+		case sop.IsInsert():
+			ret = append(ret, SubOp{N: u.Len(sop.S), S: sop.S})
+		case sop.IsDelete():
+			ret = append(ret, SubOp{N: -u.Len(sop.S), S: sop.S})
+			docIx += len(sop.S)
+		}
+	}
+	return ret, nil
+}
+
+// splitsRune reports whether position i of doc lies inside a multi-byte
+// UTF-8 sequence. Bytes which are not valid UTF-8 never count as split.
+func splitsRune(doc []byte, i int) bool {
+	if i <= 0 || i >= len(doc) || utf8.RuneStart(doc[i]) {
+		return false
+	}
+	for j := i - 1; j >= 0 && j >= i-utf8.UTFMax+1; j-- {
+		if utf8.RuneStart(doc[j]) {
+			_, size := utf8.DecodeRune(doc[j:])
+			return j+size > i
+		}
+	}
+	return false
+}
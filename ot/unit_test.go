@@ -0,0 +1,54 @@
+package ot
+
+import (
+	"testing"
+)
+
+func TestUnits(t *testing.T) {
+	doc := []byte("a€😀b")
+
+	// insert after the emoji, counted in each unit
+	ops := map[Unit]Op{
+		Bytes: {{N: 8}, {N: 1, S: "x"}, {N: 1}},
+		Runes: {{N: 3}, {N: 1, S: "x"}, {N: 1}},
+		UTF16: {{N: 4}, {N: 1, S: "x"}, {N: 1}},
+	}
+	for u, op := range ops {
+		bop, err := op.ToBytes(doc, u)
+		if err != nil {
+			t.Fatal(u, err)
+		}
+		if !bop.Equals(ops[Bytes]) {
+			t.Error(u, "ToBytes:", bop)
+		}
+		uop, err := bop.FromBytes(doc, u)
+		if err != nil {
+			t.Fatal(u, err)
+		}
+		if !uop.Equals(op) {
+			t.Error(u, "FromBytes:", uop)
+		}
+	}
+
+	if _, err := (Op{{N: 3}, {N: 2}}).ToBytes(doc, UTF16); err == nil {
+		t.Error("split surrogate pair not detected")
+	}
+
+	b := make([]byte, len(doc))
+	copy(b, doc)
+	if _, err := (Op{{N: 2}, {N: 1, S: "x"}, {N: 8}}).ApplyTo(b); err == nil {
+		t.Error("split UTF-8 sequence not detected")
+	}
+	copy(b, doc)
+	if _, err := (Op{{N: 1}, {N: -2, S: "\xe2\x82"}, {N: 7}}).ApplyTo(b); err == nil {
+		t.Error("split UTF-8 sequence not detected")
+	}
+
+	b, err := (Op{{N: 4}, {N: 1, S: "x"}, {N: -4, S: "😀"}, {N: 1}}).ApplyTo(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "a€xb" {
+		t.Errorf("got %q", b)
+	}
+}
@@ -0,0 +1,138 @@
+package ot
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Reasons an op is invalid, wrapped in an *InvalidOpError.
+var (
+	// ErrMalformed is a subop which is neither a retain, an insert nor a
+	// delete, such as a negative retain or text not matching its length.
+	ErrMalformed = errors.New("malformed subop")
+	// ErrBaseLength is an op which does not span the document it is
+	// applied to.
+	ErrBaseLength = errors.New("base length does not match the document")
+	// ErrDeleteMismatch is a delete of text not found in the document.
+	ErrDeleteMismatch = errors.New("deleted text does not match the document")
+	// ErrSplitsRune is an op which splits a UTF-8 encoded character.
+	ErrSplitsRune = errors.New("op splits a UTF-8 encoded character")
+	// ErrTooLarge is an op exceeding the Limits of a document. It is
+	// wrapped by ErrOpTooLarge and ErrDocTooLarge.
+	ErrTooLarge = errors.New("op exceeds the size limits")
+	// ErrOpTooLarge is an op with too many subops or inserting and
+	// deleting too many bytes.
+	ErrOpTooLarge = fmt.Errorf("%w: op too large", ErrTooLarge)
+	// ErrDocTooLarge is an op growing the document beyond its limit.
+	ErrDocTooLarge = fmt.Errorf("%w: document too large", ErrTooLarge)
+)
+
+// InvalidOpError describes why an op has been rejected. SubOp is the index
+// of the offending subop, -1 if the op as a whole is at fault.
+type InvalidOpError struct {
+	SubOp int
+	Err   error
+}
+
+func (e *InvalidOpError) Error() string {
+	if e.SubOp < 0 {
+		return "invalid op: " + e.Err.Error()
+	}
+	return fmt.Sprintf("invalid op at subop %d: %v", e.SubOp, e.Err)
+}
+
+func (e *InvalidOpError) Unwrap() error {
+	return e.Err
+}
+
+func invalid(i int, err error) error {
+	return &InvalidOpError{SubOp: i, Err: err}
+}
+
+// Limits bounds the ops applied to a document. Zero fields are unlimited.
+type Limits struct {
+	// MaxSubOps is the largest number of subops in an op.
+	MaxSubOps int
+	// MaxOpSize is the largest number of bytes an op inserts and deletes.
+	MaxOpSize int
+	// MaxDocSize is the largest document in bytes an op may produce.
+	MaxDocSize int
+}
+
+// Check reports whether op, applied to a document of baseLen bytes, stays
+// within the limits.
+func (l Limits) Check(op Op, baseLen int) error {
+	if l.MaxSubOps > 0 && len(op) > l.MaxSubOps {
+		return invalid(-1, ErrOpTooLarge)
+	}
+	_, del, ins := op.Count()
+	if l.MaxOpSize > 0 && del+ins > l.MaxOpSize {
+		return invalid(-1, ErrOpTooLarge)
+	}
+	if l.MaxDocSize > 0 && ins > del && baseLen-del+ins > l.MaxDocSize {
+		return invalid(-1, ErrDocTooLarge)
+	}
+	return nil
+}
+
+// wellFormed checks every subop is a noop, a retain, an insert or a delete
+// whose text matches its length.
+func (op Op) wellFormed() error {
+	for i, sop := range op {
+		switch {
+		case sop.N == 0:
+			if sop.S != "" {
+				return invalid(i, ErrMalformed)
+			}
+		case sop.N > 0:
+			if sop.S != "" && len(sop.S) != sop.N {
+				return invalid(i, ErrMalformed)
+			}
+		case len(sop.S) != -sop.N:
+			return invalid(i, ErrMalformed)
+		}
+	}
+	return nil
+}
+
+// Validate checks op is well formed and spans a document of baseLen bytes.
+func (op Op) Validate(baseLen int) error {
+	err := op.wellFormed()
+	if err != nil {
+		return err
+	}
+	ret, del, _ := op.Count()
+	if ret+del != baseLen {
+		return invalid(-1, ErrBaseLength)
+	}
+	return nil
+}
+
+// ValidateFor checks op can be applied to doc without modifying it: it has
+// to be valid for the length of doc, delete text found in doc and leave
+// UTF-8 encoded characters intact.
+func (op Op) ValidateFor(doc []byte) error {
+	err := op.Validate(len(doc))
+	if err != nil {
+		return err
+	}
+	ix := 0
+	for i, sop := range op {
+		if splitsRune(doc, ix) {
+			return invalid(i, ErrSplitsRune)
+		}
+		switch {
+		case sop.IsRetain():
+			ix += sop.N
+		case sop.IsDelete():
+			if string(doc[ix:ix-sop.N]) != sop.S {
+				return invalid(i, ErrDeleteMismatch)
+			}
+			ix -= sop.N
+		}
+	}
+	if splitsRune(doc, ix) {
+		return invalid(len(op), ErrSplitsRune)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package ot
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	doc := []byte("Hello Wörld!")
+	tests := []struct {
+		op  Op
+		err error
+	}{
+		{Op{}.Retain(6).Insert("wide ").Retain(7), nil},
+		{Op{}.Delete("Hello").Retain(8), nil},
+		{Op{}.Retain(12), ErrBaseLength},
+		{Op{}.Retain(6).Insert("x").Retain(8), ErrBaseLength},
+		{Op{{N: -5}, {N: 8}}, ErrMalformed},
+		{Op{{N: 3, S: "ab"}, {N: 13}}, ErrMalformed},
+		{Op{{N: 0, S: "a"}, {N: 13}}, ErrMalformed},
+		{Op{}.Delete("Howdy").Retain(8), ErrDeleteMismatch},
+		{Op{}.Retain(8).Insert("x").Retain(5), ErrSplitsRune},
+		{Op{}.Retain(7).Delete("\xc3").Retain(5), ErrSplitsRune},
+	}
+	for _, test := range tests {
+		err := test.op.ValidateFor(doc)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%v: got %v, want %v", test.op, err, test.err)
+		}
+		if err == nil {
+			continue
+		}
+		var ie *InvalidOpError
+		if !errors.As(err, &ie) {
+			t.Errorf("%v: untyped error %v", test.op, err)
+		}
+
+		// invalid ops leave the document alone
+		buf := make([]byte, len(doc), 64)
+		copy(buf, doc)
+		if _, err = test.op.ApplyTo(buf); err == nil || string(buf) != string(doc) {
+			t.Errorf("%v: applied to %q", test.op, buf)
+		}
+	}
+}
+
+func TestTransformMalformed(t *testing.T) {
+	good := Op{}.Retain(5)
+	for _, bad := range []Op{
+		{{N: -3}, {N: 2}},
+		{{N: 2, S: "abc"}, {N: 5}},
+		Op{}.Retain(7),
+	} {
+		if _, _, err := Transform(good, bad); err == nil {
+			t.Errorf("transformed %v", bad)
+		}
+		if _, _, err := Transform(bad, good); err == nil {
+			t.Errorf("transformed %v", bad)
+		}
+		if _, err := Compose(good, bad); err == nil {
+			t.Errorf("composed %v", bad)
+		}
+	}
+}
+
+func TestDocLimits(t *testing.T) {
+	d := NewDoc([]byte("Hello World!"))
+	d.Limits = Limits{MaxOpSize: 8, MaxDocSize: 20}
+
+	if _, err := d.Apply(1, 0, Op{}.Retain(12).Insert(" and stuff")); !errors.Is(err, ErrOpTooLarge) {
+		t.Error("op larger than the limit:", err)
+	}
+	if _, err := d.Apply(1, 0, Op{}.Retain(12).Insert(" & more")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Apply(2, 0, Op{}.Insert("Oh, ").Retain(12)); !errors.Is(err, ErrDocTooLarge) || !errors.Is(err, ErrTooLarge) {
+		t.Error("document larger than the limit:", err)
+	}
+	if _, err := d.Apply(2, 0, Op{}.Retain(13)); !errors.Is(err, ErrBaseLength) {
+		t.Error("op for another document:", err)
+	}
+	if string(d.Bytes()) != "Hello World! & more" || d.Rev() != 1 {
+		t.Errorf("got %q at revision %d", d.Bytes(), d.Rev())
+	}
+}
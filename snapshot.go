@@ -0,0 +1,59 @@
+package weeded
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// snapshotInterval is the number of ops after which a File writes a new
+// snapshot.
+const snapshotInterval = 1000
+
+// readJSON decodes the file filename into v. A missing file leaves v
+// untouched.
+func readJSON(filename string, v interface{}) error {
+	buf, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+func writeJSON(filename string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, buf, 0644)
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory and
+// renames it to filename once it has been synced to disk.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+package weeded
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dane-unltd/weeded/ot"
+)
+
+// OpStore persists the op log and the latest snapshot of a File. Ops are
+// addressed by their history index.
+type OpStore interface {
+	// Append adds an op to the end of the log. Its index must be the next
+	// index returned by Bounds.
+	Append(otmsg OtMsg) error
+	// Range returns the ops with history indices from up to, but not
+	// including, to.
+	Range(from, to int64) ([]OtMsg, error)
+	// Bounds returns the index of the first op in the log and the index
+	// the next op will be stored at.
+	Bounds() (first, next int64)
+	// Snapshot returns the latest snapshot. A store without one returns the
+	// empty snapshot at index 0.
+	Snapshot() (Snapshot, error)
+	WriteSnapshot(snap Snapshot) error
+	// Truncate drops all ops before history index keep. A snapshot at or
+	// after keep must have been written before.
+	Truncate(keep int64) error
+	Close() error
+}
+
+// ErrCompacted is returned for ops which have been dropped from the log by
+// Truncate.
+var ErrCompacted = errors.New("history has been compacted")
+
+// Snapshot records the content of a file at history index Ix. Disk is the
+// revision last written to disk, when the file had modification time
+// DiskMod and size DiskSize. Seqs holds the sequence numbers of the ops
+// before Ix.
+type Snapshot struct {
+	Ix      int64
+	Content []byte
+	Seqs    ot.SeqTable `json:",omitempty"`
+
+	Disk     int64
+	DiskMod  time.Time
+	DiskSize int64
+}
+
+// StoreSuffix ends the names of all files the stores keep next to a file.
+const StoreSuffix = ".weeded"
+
+// StoreFiles returns the existing files kept by any of the stores next to
+// filename, so they can be moved or removed together with it.
+func StoreFiles(filename string) ([]string, error) {
+	gens, err := filepath.Glob(filename + ".master.*" + StoreSuffix)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, suffix := range []string{".snapshot", ".master", ".flat", ".ops"} {
+		files = append(files, filename+suffix+StoreSuffix)
+	}
+	for _, gen := range gens {
+		n := strings.TrimSuffix(strings.TrimPrefix(gen, filename+".master."), StoreSuffix)
+		if n != "" && strings.Trim(n, "0123456789") == "" {
+			files = append(files, gen)
+		}
+	}
+
+	ret := files[:0]
+	for _, name := range files {
+		_, err := os.Lstat(name)
+		if err == nil {
+			ret = append(ret, name)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
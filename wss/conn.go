@@ -19,6 +19,13 @@ const (
 type Connection struct {
 	ws   *websocket.Conn
 	send chan *Message
+	user string
+}
+
+// User returns the name of the authenticated user, empty without
+// Service.Auth.
+func (c *Connection) User() string {
+	return c.user
 }
 
 // write writes a message with the given message type and payload.
@@ -41,6 +48,12 @@ func (c *Connection) writePump(s *Service) {
 				c.write(websocket.CloseMessage, []byte{})
 				return
 			}
+			if message.Frame != nil {
+				if err := c.write(websocket.BinaryMessage, message.Frame); err != nil {
+					return
+				}
+				continue
+			}
 			buf, err := json.Marshal(message)
 			if err != nil {
 				return
@@ -57,28 +70,56 @@ func (c *Connection) writePump(s *Service) {
 }
 
 func (c *Connection) Send(id MsgID, data interface{}) error {
+	return c.SendDoc(id, 0, data)
+}
+
+// SendDoc sends a message referring to the document doc.
+func (c *Connection) SendDoc(id MsgID, doc uint64, data interface{}) error {
 	jdata, err := json.Marshal(data)
 	if err != nil {
 		log.Println(err)
 		return err
 	}
+	return c.enqueue(&Message{ID: id, Doc: doc, Data: (*json.RawMessage)(&jdata)})
+}
+
+// SendFrame sends frame as a binary message.
+func (c *Connection) SendFrame(frame []byte) error {
+	return c.enqueue(&Message{Frame: frame})
+}
+
+func (c *Connection) enqueue(message *Message) error {
 	select {
-	case c.send <- &Message{id, (*json.RawMessage)(&jdata)}:
+	case c.send <- message:
 		return nil
 	default:
 		return errors.New("send buffer full")
 	}
 }
 
-// Read a JSON msg from the websocket
+// Close closes the websocket, making Receive fail.
+func (c *Connection) Close() error {
+	return c.ws.Close()
+}
+
+// Read a msg from the websocket. JSON is read from text messages, binary
+// messages are returned in Frame.
 func (c *Connection) Receive() (*Message, error) {
 	c.ws.SetReadLimit(maxMessageSize)
 	c.ws.SetReadDeadline(time.Now().Add(pongWait))
 	c.ws.SetPongHandler(func(string) error { c.ws.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 
-	c.ws.ReadMessage()
+	mt, buf, err := c.ws.ReadMessage()
+	if err != nil {
+		c.ws.Close()
+		return nil, err
+	}
 	var msg Message
-	if err := c.ws.ReadJSON(&msg); err != nil {
+	if mt == websocket.BinaryMessage {
+		msg.Frame = buf
+		return &msg, nil
+	}
+	if err := json.Unmarshal(buf, &msg); err != nil {
 		c.ws.Close()
 		return nil, err
 	}
@@ -6,6 +6,8 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 )
 
@@ -13,11 +15,27 @@ type MsgID string
 
 type Message struct {
 	ID   MsgID
+	Doc  uint64 `json:",omitempty"`
 	Data *json.RawMessage
+
+	// Frame holds a message sent as a binary websocket message. It is
+	// passed on as is, without ID and Data.
+	Frame []byte `json:"-"`
 }
 
 type Service struct {
 	newConn chan<- *Connection
+
+	// Auth authenticates the upgrade request of a websocket and returns
+	// the name of the user. Requests it returns an error for are refused.
+	// Without Auth all requests are accepted anonymously.
+	Auth func(r *http.Request) (user string, err error)
+
+	// CheckOrigin reports whether a websocket may be opened by the page
+	// the upgrade request r comes from. Without CheckOrigin only pages
+	// served from the host of the websocket are allowed, so other sites
+	// cannot use the cookies of a browser to open one.
+	CheckOrigin func(r *http.Request) bool
 }
 
 type Listener struct {
@@ -34,6 +52,23 @@ func (s *Service) wsHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", 405)
 		return
 	}
+	checkOrigin := s.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(r) {
+		http.Error(w, "Origin not allowed", 403)
+		return
+	}
+	var user string
+	if s.Auth != nil {
+		var err error
+		user, err = s.Auth(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", 401)
+			return
+		}
+	}
 	ws, err := websocket.Upgrade(w, r, nil, 1024, 1024)
 	if _, ok := err.(websocket.HandshakeError); ok {
 		http.Error(w, "Not a websocket handshake", 400)
@@ -45,6 +80,7 @@ func (s *Service) wsHandler(w http.ResponseWriter, r *http.Request) {
 	c := &Connection{
 		send: make(chan *Message, 256),
 		ws:   ws,
+		user: user,
 	}
 
 	c.ws.SetReadLimit(maxMessageSize)
@@ -57,6 +93,20 @@ func (s *Service) wsHandler(w http.ResponseWriter, r *http.Request) {
 	c.writePump(s)
 }
 
+// sameOrigin accepts requests without an Origin header, which are not sent
+// by browsers, and requests from a page on the host they are sent to.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
 func (s *Service) Listen(netw, addr string, uri string) *Listener {
 	http.HandleFunc(uri, s.wsHandler)
 